@@ -3,36 +3,64 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go/aws"
 
 	uuid "github.com/satori/go.uuid"
+
+	"ecr.amazon.com/spec"
 )
 
-// ScanSpec represents configuration for the target repository
-type ScanSpec struct {
-	// ID is a unique identifier for the scan spec
-	ID string `json:"id"`
-	// CreationTime is the UTC timestamp of when the scan spec was created
-	CreationTime string `json:"created"`
-	// Region specifies the region the repository is in
-	Region string `json:"region"`
-	// RegistryID specifies the registry ID
-	RegistryID string `json:"registry"`
-	// Repository specifies the repository name
-	Repository string `json:"repository"`
-	// Tags to take into consideration, if empty, all tags will be scanned
-	Tags []string `json:"tags"`
+// errPreconditionFailed signals that the If-Match header of a request
+// doesn't match the current revision of the scan spec
+var errPreconditionFailed = errors.New("scan config has been modified concurrently")
+
+// configsPage is the response to a paginated listing of scan configs
+type configsPage struct {
+	Configs []spec.ScanSpec `json:"configs"`
+	// Errors lists the scan configs of the page that can't be loaded
+	Errors []configError `json:"errors,omitempty"`
+	// Next is the cursor to pass to fetch the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// configError stands in for a listed scan config that can't be loaded
+type configError struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// maxPageSize caps the limit query parameter of a paginated listing
+const maxPageSize = 1000
+
+// pageParams returns the limit and next query parameters of a listing
+// request, and whether the client asked for a paginated listing at all
+func pageParams(request events.APIGatewayProxyRequest) (int, string, bool, *ValidationError) {
+	rawlimit, haslimit := request.QueryStringParameters["limit"]
+	cursor, hasnext := request.QueryStringParameters["next"]
+	if !haslimit && !hasnext {
+		return 0, "", false, nil
+	}
+	limit := maxPageSize
+	if haslimit {
+		l, err := strconv.Atoi(rawlimit)
+		if err != nil || l < 1 || l > maxPageSize {
+			ve := &ValidationError{}
+			ve.add("limit", "must be a number between 1 and %v", maxPageSize)
+			return 0, "", true, ve
+		}
+		limit = l
+	}
+	return limit, cursor, true, nil
 }
 
 func serverError(err error) (events.APIGatewayProxyResponse, error) {
@@ -46,96 +74,205 @@ func serverError(err error) (events.APIGatewayProxyResponse, error) {
 	}, nil
 }
 
-// storeScanSpec stores the scan spec in a given bucket
-func storeScanSpec(configbucket string, scanspec ScanSpec) error {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+func badRequest(ve *ValidationError) (events.APIGatewayProxyResponse, error) {
+	fmt.Println(ve.Error())
+	vejson, err := json.Marshal(ve)
 	if err != nil {
-		return err
+		return serverError(err)
 	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusBadRequest,
+		Headers: map[string]string{
+			"Content-Type":                "application/json",
+			"Access-Control-Allow-Origin": "*",
+		},
+		Body: string(vejson),
+	}, nil
+}
+
+func preconditionFailed() (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusPreconditionFailed,
+		Headers: map[string]string{
+			"Content-Type":                "application/json",
+			"Access-Control-Allow-Origin": "*",
+		},
+		Body: "This scan config has been modified in the meantime, no operation performed",
+	}, nil
+}
+
+func notFound() (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusNotFound,
+		Headers: map[string]string{
+			"Content-Type":                "application/json",
+			"Access-Control-Allow-Origin": "*",
+		},
+		Body: "This scan config does not exist, no operation performed",
+	}, nil
+}
+
+func specResponse(scanspec spec.ScanSpec) (events.APIGatewayProxyResponse, error) {
 	ssjson, err := json.Marshal(scanspec)
 	if err != nil {
-		return err
-	}
-	// Create an S3 Client with the config
-	client := s3.NewFromConfig(cfg)
-
-	// Create an uploader passing it the client
- 	uploader := manager.NewUploader(client)
-
-	// uploader := manager.NewUploader(cfg)
-	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(configbucket),
-		Key:    aws.String(scanspec.ID + ".json"),
-		Body:   strings.NewReader(string(ssjson)),
-	})
-	return err
-}
-
-// fetchScanSpec returns the scan spec
-// in a given bucket, with a given scan ID
-func fetchScanSpec(configbucket, scanid string) (ScanSpec, error) {
-	ss := ScanSpec{}
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return ss, err
+		return serverError(err)
 	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type":                "application/json",
+			"Access-Control-Allow-Origin": "*",
+			"ETag":                        etag(scanspec),
+		},
+		Body: string(ssjson),
+	}, nil
+}
 
-	// Create an S3 Client with the config
-	client := s3.NewFromConfig(cfg)
-
-	// Create an uploader passing it the client
-	downloader := manager.NewDownloader(client)
+// etag returns the entity tag of the scan spec, derived from its revision
+func etag(scanspec spec.ScanSpec) string {
+	return strconv.Quote(strconv.Itoa(scanspec.Revision))
+}
 
-	buf := aws.NewWriteAtBuffer([]byte{})
+// ifMatch returns the value of the If-Match header of the request, if any
+func ifMatch(request events.APIGatewayProxyRequest) string {
+	for name, value := range request.Headers {
+		if strings.EqualFold(name, "If-Match") {
+			return value
+		}
+	}
+	return ""
+}
 
-	_, err = downloader.Download(context.TODO(), buf, &s3.GetObjectInput{
-		Bucket: aws.String(configbucket),
-		Key:    aws.String(scanid + ".json"),
-	})
-	if err != nil {
-		return ss, err
+// checkIfMatch returns errPreconditionFailed unless the If-Match header
+// value is empty, a wildcard, or lists the current ETag of the scan spec
+func checkIfMatch(ifmatch string, scanspec spec.ScanSpec) error {
+	if ifmatch == "" {
+		return nil
 	}
-	err = json.Unmarshal(buf.Bytes(), &ss)
-	if err != nil {
-		return ss, err
+	current := etag(scanspec)
+	for _, tag := range strings.Split(ifmatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			return nil
+		}
 	}
-	return ss, nil
+	return errPreconditionFailed
 }
 
-// rmClusterSpec deletes the scan spec in a given bucket
-func rmClusterSpec(configbucket, scanid string) error {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return err
-	}
-	svc := s3.NewFromConfig(cfg)
-	_, err = svc.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(configbucket),
-		Key:    aws.String(scanid + ".json"),
-	})
-	// _, err = req.Send(context.Background())
-	if err != nil {
-		return err
+// maxUpdateAttempts is how often an update is applied again to the scan
+// spec as stored, if it changed between reading and writing it
+const maxUpdateAttempts = 3
+
+// updateScanSpec applies the JSON payload of an update request to the
+// stored scan spec with the given scan ID. With merge set, only the fields
+// present in the payload are changed (PATCH), otherwise the payload
+// replaces the spec entirely (PUT). In both cases ID, CreationTime and
+// LastRun of the stored spec are retained and the revision is incremented. A
+// non-empty ifmatch must match the ETag of the stored spec, and the
+// updated spec has to pass validate, unless that's nil.
+// The spec is written only if it still has the revision the update was
+// based on, otherwise the update is applied again to the spec as stored,
+// checking ifmatch anew.
+func updateScanSpec(ctx context.Context, store spec.SpecStore, scanid, payload, ifmatch string, merge bool, validate func(spec.ScanSpec) error) (spec.ScanSpec, error) {
+	current := spec.ScanSpec{}
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var err error
+		current, err = store.Fetch(ctx, scanid)
+		if err != nil {
+			return current, err
+		}
+		err = checkIfMatch(ifmatch, current)
+		if err != nil {
+			return current, err
+		}
+		ss := spec.ScanSpec{}
+		if merge {
+			ss = current
+		}
+		err = decodeScanSpec(payload, &ss)
+		if err != nil {
+			return current, err
+		}
+		if validate != nil {
+			err = validate(ss)
+			if err != nil {
+				return current, err
+			}
+		}
+		ss.ID = current.ID
+		ss.CreationTime = current.CreationTime
+		ss.LastRun = current.LastRun
+		ss.Revision = current.Revision + 1
+		ss.ModificationTime = fmt.Sprintf("%v", time.Now().Unix())
+		err = store.StoreIf(ctx, ss, current.Revision)
+		if errors.Is(err, spec.ErrConflict) {
+			fmt.Printf("DEBUG:: scan config %v changed while updating it\n", scanid)
+			continue
+		}
+		if err != nil {
+			return current, err
+		}
+		return ss, nil
 	}
-	return nil
+	return current, errPreconditionFailed
 }
 
-func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	configbucket := os.Getenv("ECR_SCAN_CONFIG_BUCKET")
-	fmt.Printf("DEBUG:: config continuous scan start\n")
+// toggles maps the actions of POST /configs/{id}/{action} to the partial
+// update they apply; enabling a scan config also ends its snooze. The
+// updates only set enabled and clear snoozeUntil, which is always valid, so
+// the rest of the scan config isn't validated: a scan config that no longer
+// passes validation, for example as its role was removed from
+// ECR_SCAN_ALLOWED_ROLE_ARNS, can still be turned off.
+var toggles = map[string]string{
+	"enable":  `{"enabled": true, "snoozeUntil": ""}`,
+	"disable": `{"enabled": false}`,
+}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+// updateResponse returns the response to an update of a scan spec
+func updateResponse(ss spec.ScanSpec, err error) (events.APIGatewayProxyResponse, error) {
 	if err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			return preconditionFailed()
+		}
+		var ve *ValidationError
+		if errors.As(err, &ve) {
+			return badRequest(ve)
+		}
+		if errors.Is(err, spec.ErrNotFound) {
+			return notFound()
+		}
 		return serverError(err)
 	}
-	svc := s3.NewFromConfig(cfg)
+	return specResponse(ss)
+}
+
+var store spec.SpecStore
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	fmt.Printf("DEBUG:: config continuous scan start\n")
 
 	switch request.HTTPMethod {
 	case "POST":
+		if scanID, ok := request.PathParameters["id"]; ok {
+			action := path.Base(request.Path)
+			payload, ok := toggles[action]
+			if !ok {
+				return notFound()
+			}
+			fmt.Printf("DEBUG:: %v scan config %v\n", action, scanID)
+			return updateResponse(updateScanSpec(ctx, store, scanID, payload, ifMatch(request), true, nil))
+		}
 		fmt.Printf("DEBUG:: adding scan config\n")
-		ss := ScanSpec{}
-		// Unmarshal the JSON payload in the POST:
-		err := json.Unmarshal([]byte(request.Body), &ss)
+		ss := spec.ScanSpec{}
+		// Unmarshal and validate the JSON payload in the POST:
+		err := decodeScanSpec(request.Body, &ss)
+		if err == nil {
+			err = validateScanSpec(ss)
+		}
+		var ve *ValidationError
+		if errors.As(err, &ve) {
+			return badRequest(ve)
+		}
 		if err != nil {
 			return serverError(err)
 		}
@@ -145,7 +282,10 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		// }
 		ss.ID = specID.String()
 		ss.CreationTime = fmt.Sprintf("%v", time.Now().Unix())
-		err = storeScanSpec(configbucket, ss)
+		ss.ModificationTime = ""
+		ss.LastRun = ""
+		ss.Revision = 1
+		err = store.Store(ctx, ss)
 		if err != nil {
 			return serverError(err)
 		}
@@ -161,63 +301,106 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 	case "DELETE":
 		fmt.Printf("DEBUG:: removing scan config\n")
 		// validate ID in URL path:
-		if _, ok := request.PathParameters["id"]; !ok {
+		scanID, ok := request.PathParameters["id"]
+		if !ok {
 			return serverError(fmt.Errorf("Unknown configuration"))
 		}
-		resp, err := svc.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-			Bucket: &configbucket,
-		},
-		)
-		// resp, err := req.Send(context.TODO())
+		ss, err := store.Fetch(ctx, scanID)
 		if err != nil {
+			if errors.Is(err, spec.ErrNotFound) {
+				return notFound()
+			}
 			return serverError(err)
 		}
-		for _, obj := range resp.Contents {
-			fn := *obj.Key
-			scanID := strings.TrimSuffix(fn, ".json")
-			if scanID == request.PathParameters["id"] {
-				rmClusterSpec(configbucket, scanID)
-				msg := fmt.Sprintf("Deleted scan config %v ", request.PathParameters["id"])
-				return events.APIGatewayProxyResponse{
-					StatusCode: http.StatusOK,
-					Headers: map[string]string{
-						"Content-Type":                "application/json",
-						"Access-Control-Allow-Origin": "*",
-					},
-					Body: msg,
-				}, nil
-			}
+		if checkIfMatch(ifMatch(request), ss) != nil {
+			return preconditionFailed()
+		}
+		// without If-Match, the scan config goes regardless of its revision:
+		if ifMatch(request) == "" {
+			err = store.Remove(ctx, scanID)
+		} else {
+			err = store.RemoveIf(ctx, scanID, ss.Revision)
+		}
+		if errors.Is(err, spec.ErrConflict) {
+			return preconditionFailed()
+		}
+		if err != nil {
+			return serverError(err)
 		}
+		msg := fmt.Sprintf("Deleted scan config %v ", scanID)
 		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusNotFound,
+			StatusCode: http.StatusOK,
 			Headers: map[string]string{
 				"Content-Type":                "application/json",
 				"Access-Control-Allow-Origin": "*",
 			},
-			Body: "This scan config does not exist, no operation performed",
+			Body: msg,
 		}, nil
+	case "PUT", "PATCH":
+		fmt.Printf("DEBUG:: updating scan config\n")
+		// validate ID in URL path:
+		scanID, ok := request.PathParameters["id"]
+		if !ok {
+			return serverError(fmt.Errorf("Unknown configuration"))
+		}
+		return updateResponse(updateScanSpec(ctx, store, scanID, request.Body, ifMatch(request), request.HTTPMethod == "PATCH", validateScanSpec))
 	case "GET":
+		if scanID, ok := request.PathParameters["id"]; ok {
+			fmt.Printf("DEBUG:: fetching scan config %v\n", scanID)
+			ss, err := store.Fetch(ctx, scanID)
+			if err != nil {
+				if errors.Is(err, spec.ErrNotFound) {
+					return notFound()
+				}
+				return serverError(err)
+			}
+			return specResponse(ss)
+		}
 		fmt.Printf("DEBUG:: listing scan config\n")
-		resp, err := svc.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-			Bucket: &configbucket,
-		},
-		)
-		// resp, err := req.Send(context.TODO())
+		limit, cursor, paged, ve := pageParams(request)
+		if ve != nil {
+			return badRequest(ve)
+		}
+		var results []spec.Result
+		next := ""
+		var err error
+		if paged {
+			results, next, err = store.List(ctx, limit, cursor)
+		} else {
+			results, err = spec.ListAll(ctx, store)
+		}
+		if errors.Is(err, spec.ErrInvalidCursor) {
+			ve := &ValidationError{}
+			ve.add("next", "invalid cursor")
+			return badRequest(ve)
+		}
 		if err != nil {
 			return serverError(err)
 		}
-		scanspecs := []ScanSpec{}
-		for _, obj := range resp.Contents {
-			fn := *obj.Key
-			scanID := strings.TrimSuffix(fn, ".json")
-			scanspec, err := fetchScanSpec(configbucket, scanID)
-			if err != nil {
-				return serverError(err)
+		// a scan config that can't be loaded doesn't fail the listing of the
+		// others, it's listed as an error in its place instead:
+		scanspecs := []spec.ScanSpec{}
+		loadErrors := []configError{}
+		listed := []interface{}{}
+		for _, loaded := range results {
+			switch {
+			case errors.Is(loaded.Err, spec.ErrNotFound):
+				// removed since the IDs were listed
+			case loaded.Err != nil:
+				fmt.Printf("Can't load scan config %v: %v\n", loaded.ID, loaded.Err)
+				loadError := configError{ID: loaded.ID, Error: fmt.Sprintf("can't load scan config: %v", loaded.Err)}
+				loadErrors = append(loadErrors, loadError)
+				listed = append(listed, loadError)
+			default:
+				scanspecs = append(scanspecs, loaded.Spec)
+				listed = append(listed, loaded.Spec)
 			}
-			scanspecs = append(scanspecs, scanspec)
-
 		}
-		scanspecsjson, err := json.Marshal(scanspecs)
+		var body interface{} = listed
+		if paged {
+			body = configsPage{Configs: scanspecs, Errors: loadErrors, Next: next}
+		}
+		scanspecsjson, err := json.Marshal(body)
 		if err != nil {
 			return serverError(err)
 		}
@@ -240,5 +423,11 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 }
 
 func main() {
+	var err error
+	store, err = spec.NewFromEnv(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	lambda.Start(handler)
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"ecr.amazon.com/spec"
+)
+
+const amazonlinux = `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "tags": ["2018.03"]}`
+
+// useFileStore makes the handler use a file store in a temporary directory
+// for the duration of the test, returning the directory
+func useFileStore(t *testing.T) string {
+	dir := t.TempDir()
+	st, err := spec.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = st
+	t.Cleanup(func() { store = nil })
+	return dir
+}
+
+// call sends the request to the handler, failing the test on an error
+func call(t *testing.T, method, scanID, body, ifmatch string) events.APIGatewayProxyResponse {
+	request := events.APIGatewayProxyRequest{HTTPMethod: method, Path: "/configs", Body: body}
+	if scanID != "" {
+		request.Path += "/" + scanID
+		request.PathParameters = map[string]string{"id": scanID}
+	}
+	if ifmatch != "" {
+		request.Headers = map[string]string{"If-Match": ifmatch}
+	}
+	resp, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// create adds the scan config through the handler and returns its ID
+func create(t *testing.T, payload string) string {
+	resp := call(t, "POST", "", payload, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("creating scan config: status %v: %v", resp.StatusCode, resp.Body)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(resp.Body, "Added scan config. ID="))
+}
+
+func TestIfMatch(t *testing.T) {
+	useFileStore(t)
+	scanID := create(t, amazonlinux)
+	if resp := call(t, "GET", scanID, "", ""); resp.StatusCode != http.StatusOK || resp.Headers["ETag"] != `"1"` {
+		t.Fatalf("GET: status %v, ETag %v, want the first revision", resp.StatusCode, resp.Headers["ETag"])
+	}
+
+	steps := []struct {
+		name    string
+		method  string
+		body    string
+		ifmatch string
+		status  int
+		etag    string
+	}{
+		{"replace current revision", "PUT", amazonlinux, `"1"`, http.StatusOK, `"2"`},
+		{"replace stale revision", "PUT", amazonlinux, `"1"`, http.StatusPreconditionFailed, ""},
+		{"update weak current revision", "PATCH", `{"latest": 3}`, `W/"2"`, http.StatusOK, `"3"`},
+		{"update any of the revisions listed", "PATCH", `{"latest": 2}`, `"1", "3"`, http.StatusOK, `"4"`},
+		{"update any revision", "PATCH", `{"latest": 1}`, `*`, http.StatusOK, `"5"`},
+		{"update without If-Match", "PATCH", `{"latest": 0}`, "", http.StatusOK, `"6"`},
+		{"disable stale revision", "POST", "", `"5"`, http.StatusPreconditionFailed, ""},
+		{"delete stale revision", "DELETE", "", `"5"`, http.StatusPreconditionFailed, ""},
+		{"delete current revision", "DELETE", "", `"6"`, http.StatusOK, ""},
+		{"update deleted", "PATCH", `{"latest": 1}`, `"6"`, http.StatusNotFound, ""},
+		{"delete deleted", "DELETE", "", `"6"`, http.StatusNotFound, ""},
+	}
+	for _, step := range steps {
+		id := scanID
+		request := events.APIGatewayProxyRequest{HTTPMethod: step.method, Path: "/configs/" + id, Body: step.body,
+			PathParameters: map[string]string{"id": id}}
+		if step.method == "POST" {
+			request.Path += "/disable"
+		}
+		if step.ifmatch != "" {
+			// header names are case-insensitive:
+			request.Headers = map[string]string{"if-match": step.ifmatch}
+		}
+		resp, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != step.status {
+			t.Fatalf("%v: status %v, want %v: %v", step.name, resp.StatusCode, step.status, resp.Body)
+		}
+		if resp.Headers["ETag"] != step.etag {
+			t.Errorf("%v: ETag %q, want %q", step.name, resp.Headers["ETag"], step.etag)
+		}
+		if step.etag == "" {
+			continue
+		}
+		stored := spec.ScanSpec{}
+		if err := json.Unmarshal([]byte(resp.Body), &stored); err != nil {
+			t.Fatal(err)
+		}
+		if etag(stored) != step.etag {
+			t.Errorf("%v: returned revision %v, want ETag %v", step.name, stored.Revision, step.etag)
+		}
+	}
+}
+
+func TestIfMatchWithoutRevision(t *testing.T) {
+	dir := useFileStore(t)
+	// scan configs stored before revisions were introduced have none:
+	legacy := `{"id": "legacy", "region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "tags": ["2018.03"]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "legacy.json"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if resp := call(t, "GET", "legacy", "", ""); resp.Headers["ETag"] != `"0"` {
+		t.Fatalf("GET: ETag %v, want the zero revision", resp.Headers["ETag"])
+	}
+	if resp := call(t, "PATCH", "legacy", `{"latest": 1}`, `"1"`); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with a revision it never had: status %v, want %v", resp.StatusCode, http.StatusPreconditionFailed)
+	}
+	if resp := call(t, "PATCH", "legacy", `{"latest": 1}`, `"0"`); resp.StatusCode != http.StatusOK || resp.Headers["ETag"] != `"1"` {
+		t.Errorf("PATCH: status %v, ETag %v, want the first revision: %v", resp.StatusCode, resp.Headers["ETag"], resp.Body)
+	}
+}
+
+func TestUpdateKeepsIdentity(t *testing.T) {
+	useFileStore(t)
+	scanID := create(t, amazonlinux)
+	// backdate the scan config, so that a new timestamp stands out:
+	created, err := store.Fetch(context.Background(), scanID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created.CreationTime = "1700000000"
+	created.LastRun = "1700003600"
+	if err := store.Store(context.Background(), created); err != nil {
+		t.Fatal(err)
+	}
+
+	// the payloads try to change what only the store sets:
+	updates := []struct {
+		method string
+		body   string
+	}{
+		{"PUT", `{"id": "other", "created": "1", "modified": "1", "lastRun": "1", "region": "us-east-1", "registry": "148658015984", "repository": "amazonlinux", "tags": ["2"]}`},
+		{"PATCH", `{"id": "other", "created": "1", "modified": "1", "latest": 2}`},
+	}
+	for _, update := range updates {
+		resp := call(t, update.method, scanID, update.body, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: status %v: %v", update.method, resp.StatusCode, resp.Body)
+		}
+		updated := spec.ScanSpec{}
+		if err := json.Unmarshal([]byte(resp.Body), &updated); err != nil {
+			t.Fatal(err)
+		}
+		if updated.ID != scanID || updated.CreationTime != "1700000000" || updated.LastRun != "1700003600" {
+			t.Errorf("%v: changed ID, creation time or last run to %v, %v, %v", update.method, updated.ID, updated.CreationTime, updated.LastRun)
+		}
+		if modified, err := strconv.ParseInt(updated.ModificationTime, 10, 64); err != nil || modified < time.Now().Add(-time.Minute).Unix() {
+			t.Errorf("%v: modification time %q, want the time of the update", update.method, updated.ModificationTime)
+		}
+		stored := call(t, "GET", scanID, "", "")
+		if stored.Body != resp.Body {
+			t.Errorf("%v: stored %v, returned %v", update.method, stored.Body, resp.Body)
+		}
+	}
+	// PUT replaced the scan config, PATCH only changed latest:
+	final := spec.ScanSpec{}
+	if err := json.Unmarshal([]byte(call(t, "GET", scanID, "", "").Body), &final); err != nil {
+		t.Fatal(err)
+	}
+	if final.Region != "us-east-1" || strings.Join(final.Tags, ",") != "2" || final.Latest != 2 {
+		t.Errorf("updates left %+v", final)
+	}
+	if resp := call(t, "GET", "other", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of the ID in the payload: status %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestUnknownScanConfig(t *testing.T) {
+	useFileStore(t)
+	for _, method := range []string{"GET", "PUT", "PATCH", "DELETE"} {
+		if resp := call(t, method, "unknown", amazonlinux, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%v of an unknown scan config: status %v, want %v", method, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+// listPage lists scan configs through the handler with the given query
+func listPage(t *testing.T, query map[string]string) (configsPage, events.APIGatewayProxyResponse) {
+	resp, err := handler(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/configs", QueryStringParameters: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := configsPage{}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return page, resp
+}
+
+func TestListPages(t *testing.T) {
+	dir := useFileStore(t)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		ss := `{"id": "` + id + `", "region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux"}`
+		if err := ioutil.WriteFile(filepath.Join(dir, id+".json"), []byte(ss), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, limit := range []string{"1", "2", "5", "1000"} {
+		listed := []string{}
+		query := map[string]string{"limit": limit}
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("limit %v: cursors don't end", limit)
+			}
+			page, resp := listPage(t, query)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("limit %v: status %v: %v", limit, resp.StatusCode, resp.Body)
+			}
+			if len(page.Configs) == 0 {
+				t.Errorf("limit %v: page %v is empty", limit, pages)
+			}
+			for _, ss := range page.Configs {
+				listed = append(listed, ss.ID)
+			}
+			if page.Next == "" {
+				break
+			}
+			query["next"] = page.Next
+		}
+		if strings.Join(listed, "") != "abcde" {
+			t.Errorf("limit %v: listed %v, want all scan configs in order", limit, listed)
+		}
+	}
+
+	// the last page omits the cursor:
+	page, resp := listPage(t, map[string]string{"limit": "5"})
+	if page.Next != "" || strings.Contains(resp.Body, `"next"`) {
+		t.Errorf("last page %v has a cursor", resp.Body)
+	}
+	// a cursor alone lists the rest at the maximum page size:
+	first, _ := listPage(t, map[string]string{"limit": "2"})
+	if rest, resp := listPage(t, map[string]string{"next": first.Next}); len(rest.Configs) != 3 || rest.Next != "" {
+		t.Errorf("listing from a cursor returned %v", resp.Body)
+	}
+	// without limit and cursor, the listing is the plain array:
+	all := []spec.ScanSpec{}
+	if resp := call(t, "GET", "", "", ""); resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(resp.Body), &all) != nil || len(all) != 5 {
+		t.Errorf("unpaginated listing returned %v: %v", resp.StatusCode, resp.Body)
+	}
+
+	invalid := []map[string]string{
+		{"limit": "0"},
+		{"limit": "1001"},
+		{"limit": "-1"},
+		{"limit": "ten"},
+		{"next": "not a cursor!"},
+	}
+	for _, query := range invalid {
+		if _, resp := listPage(t, query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("listing with %v: status %v, want %v", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListWithUnloadableConfigs(t *testing.T) {
+	dir := useFileStore(t)
+	for _, id := range []string{"a", "b", "c"} {
+		ss := `{"id": "` + id + `", "region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux"}`
+		if id == "b" {
+			ss = `{"id": "b",`
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, id+".json"), []byte(ss), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, resp := listPage(t, map[string]string{"limit": "2"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %v: %v", resp.StatusCode, resp.Body)
+	}
+	if len(first.Configs) != 1 || first.Configs[0].ID != "a" || len(first.Errors) != 1 || first.Errors[0].ID != "b" || first.Errors[0].Error == "" {
+		t.Errorf("first page %v, want a and an error for b", resp.Body)
+	}
+	if rest, resp := listPage(t, map[string]string{"limit": "2", "next": first.Next}); len(rest.Configs) != 1 || rest.Configs[0].ID != "c" || strings.Contains(resp.Body, `"errors"`) {
+		t.Errorf("second page %v, want c without errors", resp.Body)
+	}
+
+	// the plain array lists the error in place of the scan config:
+	resp = call(t, "GET", "", "", "")
+	listed := []map[string]interface{}{}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(resp.Body), &listed) != nil || len(listed) != 3 {
+		t.Fatalf("unpaginated listing returned %v: %v", resp.StatusCode, resp.Body)
+	}
+	if listed[0]["region"] != "us-west-2" || listed[1]["id"] != "b" || listed[1]["error"] == nil || listed[2]["id"] != "c" {
+		t.Errorf("unpaginated listing %v, want a, an error for b, and c", resp.Body)
+	}
+}
+
+func TestToggleWithoutAllowedRole(t *testing.T) {
+	defer os.Setenv("ECR_SCAN_ALLOWED_ROLE_ARNS", os.Getenv("ECR_SCAN_ALLOWED_ROLE_ARNS"))
+	os.Setenv("ECR_SCAN_ALLOWED_ROLE_ARNS", "arn:aws:iam::*:role/ecr-continuous-scan*")
+	useFileStore(t)
+	scanID := create(t, `{"region": "eu-west-1", "registry": "210987654321", "repository": "payments/", "roleArn": "arn:aws:iam::210987654321:role/ecr-continuous-scan"}`)
+	// the operator no longer allows the role of the scan config:
+	os.Setenv("ECR_SCAN_ALLOWED_ROLE_ARNS", "arn:aws:iam::123456789012:role/ecr-continuous-scan")
+
+	for _, action := range []string{"disable", "enable"} {
+		request := events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: "/configs/" + scanID + "/" + action,
+			PathParameters: map[string]string{"id": scanID}}
+		resp, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: status %v, want %v: %v", action, resp.StatusCode, http.StatusOK, resp.Body)
+		}
+		toggled := spec.ScanSpec{}
+		if err := json.Unmarshal([]byte(resp.Body), &toggled); err != nil {
+			t.Fatal(err)
+		}
+		if toggled.IsEnabled() != (action == "enable") {
+			t.Errorf("%v: scan config is enabled %v", action, toggled.IsEnabled())
+		}
+	}
+	// any other update has to pass validation:
+	if resp := call(t, "PATCH", scanID, `{"latest": 1}`, ""); resp.StatusCode != http.StatusBadRequest || !strings.Contains(resp.Body, "roleArn") {
+		t.Errorf("PATCH: status %v, want %v for roleArn: %v", resp.StatusCode, http.StatusBadRequest, resp.Body)
+	}
+}
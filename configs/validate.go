@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"ecr.amazon.com/spec"
+)
+
+// knownRegions lists the AWS regions a scan spec may refer to
+var knownRegions = map[string]bool{
+	"af-south-1":     true,
+	"ap-east-1":      true,
+	"ap-east-2":      true,
+	"ap-northeast-1": true,
+	"ap-northeast-2": true,
+	"ap-northeast-3": true,
+	"ap-south-1":     true,
+	"ap-south-2":     true,
+	"ap-southeast-1": true,
+	"ap-southeast-2": true,
+	"ap-southeast-3": true,
+	"ap-southeast-4": true,
+	"ap-southeast-5": true,
+	"ap-southeast-7": true,
+	"ca-central-1":   true,
+	"ca-west-1":      true,
+	"cn-north-1":     true,
+	"cn-northwest-1": true,
+	"eu-central-1":   true,
+	"eu-central-2":   true,
+	"eu-north-1":     true,
+	"eu-south-1":     true,
+	"eu-south-2":     true,
+	"eu-west-1":      true,
+	"eu-west-2":      true,
+	"eu-west-3":      true,
+	"il-central-1":   true,
+	"me-central-1":   true,
+	"me-south-1":     true,
+	"mx-central-1":   true,
+	"sa-east-1":      true,
+	"us-east-1":      true,
+	"us-east-2":      true,
+	"us-gov-east-1":  true,
+	"us-gov-west-1":  true,
+	"us-west-1":      true,
+	"us-west-2":      true,
+}
+
+var (
+	// registryIDRE matches an AWS account ID, which is what ECR uses as registry ID
+	registryIDRE = regexp.MustCompile(`^[0-9]{12}$`)
+	// repositoryRE follows the ECR repository naming rules
+	repositoryRE = regexp.MustCompile(`^(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/)*[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+	// tagRE follows the image tag naming rules
+	tagRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	// digestRE matches the SHA-256 image digests ECR uses
+	digestRE = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	// roleARNRE matches the ARN of an IAM role
+	roleARNRE = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[\w+=,.@/-]{1,512}$`)
+	// externalIDRE matches the characters STS allows in external IDs
+	externalIDRE = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+)
+
+// FieldError describes a single invalid field of a scan spec
+type FieldError struct {
+	// Field is the JSON name of the offending field, empty if the payload
+	// as a whole could not be parsed
+	Field string `json:"field"`
+	// Message explains what is wrong with the field
+	Message string `json:"message"`
+}
+
+// ValidationError collects all field errors found in a scan spec
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (ve *ValidationError) Error() string {
+	msgs := []string{}
+	for _, fe := range ve.Errors {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", fe.Field, fe.Message))
+	}
+	return "invalid scan config: " + strings.Join(msgs, "; ")
+}
+
+func (ve *ValidationError) add(field, format string, args ...interface{}) {
+	ve.Errors = append(ve.Errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// decodeScanSpec unmarshals the JSON payload onto the given scan spec,
+// rejecting unknown fields. Malformed payloads are reported as a
+// ValidationError so that they end up as a client error.
+func decodeScanSpec(payload string, ss *spec.ScanSpec) error {
+	dec := json.NewDecoder(strings.NewReader(payload))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(ss)
+	if err == nil {
+		return nil
+	}
+	ve := &ValidationError{}
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		ve.add(typeErr.Field, "expected a JSON %v", typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		if unquoted, uerr := strconv.Unquote(field); uerr == nil {
+			field = unquoted
+		}
+		ve.add(field, "unknown field")
+	default:
+		ve.add("", "malformed JSON payload: %v", err)
+	}
+	return ve
+}
+
+// allowedRolesFromEnv returns the role ARN patterns listed, comma separated,
+// in ECR_SCAN_ALLOWED_ROLE_ARNS, which match the roles the functions may
+// assume according to the ScanRoleArns template parameter
+func allowedRolesFromEnv() []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(os.Getenv("ECR_SCAN_ALLOWED_ROLE_ARNS"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// roleAllowed reports whether the role ARN matches any of the patterns, in
+// which, as in the resources of IAM policies, * stands for any number of
+// characters and ? for a single one. Without patterns, no role is allowed.
+func roleAllowed(arn string, patterns []string) bool {
+	for _, pattern := range patterns {
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		if regexp.MustCompile("^" + expr + "$").MatchString(arn) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateScanSpec checks the user-provided fields of a scan spec and
+// returns a ValidationError listing every invalid field, or nil
+func validateScanSpec(ss spec.ScanSpec) error {
+	ve := &ValidationError{}
+	switch {
+	case ss.Region == "":
+		ve.add("region", "required")
+	case !knownRegions[ss.Region]:
+		ve.add("region", "unknown AWS region %q", ss.Region)
+	}
+	switch {
+	case ss.RegistryID == "":
+		ve.add("registry", "required")
+	case !registryIDRE.MatchString(ss.RegistryID):
+		ve.add("registry", "must be a 12-digit AWS account ID")
+	}
+	switch {
+	case ss.IsDiscovery():
+		if err := spec.ValidateRepositoryPattern(ss.Repository); err != nil {
+			ve.add("repository", "%v", err)
+		}
+	case len(ss.Repository) < 2 || len(ss.Repository) > 256:
+		ve.add("repository", "must be between 2 and 256 characters long")
+	case !repositoryRE.MatchString(ss.Repository):
+		ve.add("repository", "%q is not a valid ECR repository name", ss.Repository)
+	}
+	switch {
+	case ss.RoleARN == "":
+	case !roleARNRE.MatchString(ss.RoleARN):
+		ve.add("roleArn", "%q is not an IAM role ARN", ss.RoleARN)
+	case !roleAllowed(ss.RoleARN, allowedRolesFromEnv()):
+		ve.add("roleArn", "%q is not among the roles the scanner may assume", ss.RoleARN)
+	}
+	switch {
+	case ss.ExternalID == "":
+	case ss.RoleARN == "":
+		ve.add("externalId", "requires roleArn")
+	case len(ss.ExternalID) < 2 || len(ss.ExternalID) > 1224:
+		ve.add("externalId", "must be between 2 and 1224 characters long")
+	case !externalIDRE.MatchString(ss.ExternalID):
+		ve.add("externalId", "may only contain letters, digits, and _+=,.@:/-")
+	}
+	if !ss.IsDiscovery() && len(ss.IncludeRepositories)+len(ss.ExcludeRepositories) > 0 {
+		ve.add("repository", "must be a prefix or glob to include or exclude repositories")
+	}
+	for i, pattern := range ss.IncludeRepositories {
+		if err := spec.ValidateTagPattern(pattern); err != nil {
+			ve.add(fmt.Sprintf("includeRepositories[%d]", i), "%v", err)
+		}
+	}
+	for i, pattern := range ss.ExcludeRepositories {
+		if err := spec.ValidateTagPattern(pattern); err != nil {
+			ve.add(fmt.Sprintf("excludeRepositories[%d]", i), "%v", err)
+		}
+	}
+	for i, tag := range ss.Tags {
+		if !tagRE.MatchString(tag) {
+			ve.add(fmt.Sprintf("tags[%d]", i), "%q is not a valid image tag", tag)
+		}
+	}
+	for i, pattern := range ss.TagPatterns {
+		if err := spec.ValidateTagPattern(pattern); err != nil {
+			ve.add(fmt.Sprintf("tagPatterns[%d]", i), "%v", err)
+		}
+	}
+	for i, pattern := range ss.ExcludeTags {
+		if err := spec.ValidateTagPattern(pattern); err != nil {
+			ve.add(fmt.Sprintf("excludeTags[%d]", i), "%v", err)
+		}
+	}
+	for i, digest := range ss.Digests {
+		if !digestRE.MatchString(digest) {
+			ve.add(fmt.Sprintf("digests[%d]", i), "%q is not a valid image digest", digest)
+		}
+	}
+	if ss.Latest < 0 {
+		ve.add("latest", "must not be negative")
+	}
+	if ss.PushedWithinDays < 0 {
+		ve.add("pushedWithinDays", "must not be negative")
+	}
+	if ss.SnoozeUntil != "" {
+		if _, err := time.Parse(time.RFC3339, ss.SnoozeUntil); err != nil {
+			ve.add("snoozeUntil", "%q is not an RFC 3339 timestamp", ss.SnoozeUntil)
+		}
+	}
+	if ss.Schedule != "" {
+		if _, err := spec.ParseSchedule(ss.Schedule); err != nil {
+			ve.add("schedule", "%v", err)
+		}
+	}
+	if len(ve.Errors) > 0 {
+		return ve
+	}
+	return nil
+}
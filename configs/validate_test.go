@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"ecr.amazon.com/spec"
+)
+
+func TestRoleAllowed(t *testing.T) {
+	patterns := []string{
+		"arn:aws:iam::*:role/ecr-continuous-scan*",
+		"arn:aws:iam::210987654321:role/team-?/scanner",
+	}
+	tests := []struct {
+		arn     string
+		allowed bool
+	}{
+		{"arn:aws:iam::123456789012:role/ecr-continuous-scan", true},
+		{"arn:aws:iam::123456789012:role/ecr-continuous-scan-reader", true},
+		{"arn:aws:iam::123456789012:role/admin", false},
+		{"arn:aws:iam::123456789012:role/path/ecr-continuous-scan", false},
+		{"arn:aws:iam::210987654321:role/team-a/scanner", true},
+		{"arn:aws:iam::210987654321:role/team-ab/scanner", false},
+		{"arn:aws:iam::123456789012:role/team-a/scanner", false},
+		{"arn:aws-cn:iam::123456789012:role/ecr-continuous-scan", false},
+	}
+	for _, test := range tests {
+		if got := roleAllowed(test.arn, patterns); got != test.allowed {
+			t.Errorf("roleAllowed(%q) = %v, want %v", test.arn, got, test.allowed)
+		}
+	}
+	if roleAllowed("arn:aws:iam::123456789012:role/ecr-continuous-scan", nil) {
+		t.Error("roleAllowed without patterns allowed a role")
+	}
+}
+
+func TestValidateRoleARN(t *testing.T) {
+	defer os.Setenv("ECR_SCAN_ALLOWED_ROLE_ARNS", os.Getenv("ECR_SCAN_ALLOWED_ROLE_ARNS"))
+	ss := spec.ScanSpec{
+		Region:     "eu-west-1",
+		RegistryID: "210987654321",
+		Repository: "payments/",
+		RoleARN:    "arn:aws:iam::210987654321:role/ecr-continuous-scan",
+		ExternalID: "continuous-scan",
+	}
+	tests := []struct {
+		allowed string
+		valid   bool
+	}{
+		{"arn:aws:iam::*:role/ecr-continuous-scan*", true},
+		{" arn:aws:iam::123456789012:role/other , arn:aws:iam::210987654321:role/ecr-continuous-scan ", true},
+		{"arn:aws:iam::123456789012:role/ecr-continuous-scan*", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		os.Setenv("ECR_SCAN_ALLOWED_ROLE_ARNS", test.allowed)
+		err := validateScanSpec(ss)
+		if (err == nil) != test.valid {
+			t.Errorf("allowing %q: validateScanSpec returned %v, want valid %v", test.allowed, err, test.valid)
+		}
+	}
+	os.Setenv("ECR_SCAN_ALLOWED_ROLE_ARNS", "")
+	ss.RoleARN, ss.ExternalID = "", ""
+	if err := validateScanSpec(ss); err != nil {
+		t.Errorf("scan spec without role is invalid: %v", err)
+	}
+}
+
+func TestValidateRepositorySelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(ss *spec.ScanSpec)
+		invalid []string
+	}{
+		{"single repository", func(ss *spec.ScanSpec) { ss.Repository = "team/api" }, nil},
+		{"whole registry", func(ss *spec.ScanSpec) { ss.Repository = "" }, nil},
+		{"prefix", func(ss *spec.ScanSpec) { ss.Repository = "team/" }, nil},
+		{"glob", func(ss *spec.ScanSpec) { ss.Repository = "team/api-*" }, nil},
+		{"invalid glob", func(ss *spec.ScanSpec) { ss.Repository = "team/[api" }, []string{"repository"}},
+		{"invalid repository name", func(ss *spec.ScanSpec) { ss.Repository = "Team/API" }, []string{"repository"}},
+		{"included and excluded repositories", func(ss *spec.ScanSpec) {
+			ss.Repository = "team/"
+			ss.IncludeRepositories = []string{"team/api*", "re:team/(web|worker)"}
+			ss.ExcludeRepositories = []string{"team/*-legacy"}
+		}, nil},
+		{"invalid included and excluded repositories", func(ss *spec.ScanSpec) {
+			ss.Repository = ""
+			ss.IncludeRepositories = []string{"team/api", "re:(("}
+			ss.ExcludeRepositories = []string{"[legacy"}
+		}, []string{"includeRepositories[1]", "excludeRepositories[0]"}},
+		{"included repositories of a single repository", func(ss *spec.ScanSpec) {
+			ss.Repository = "team/api"
+			ss.IncludeRepositories = []string{"team/api"}
+		}, []string{"repository"}},
+	}
+	for _, test := range tests {
+		ss := spec.ScanSpec{Region: "us-west-2", RegistryID: "123456789012"}
+		test.edit(&ss)
+		err := validateScanSpec(ss)
+		fields := []string{}
+		if ve, ok := err.(*ValidationError); ok {
+			for _, fe := range ve.Errors {
+				fields = append(fields, fe.Field)
+			}
+		} else if err != nil {
+			t.Fatalf("%v: validateScanSpec returned %v, want a ValidationError", test.name, err)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.invalid, ",") {
+			t.Errorf("%v: invalid fields %v, want %v", test.name, fields, test.invalid)
+		}
+	}
+}
+
+func TestValidateScanSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		invalid []string
+	}{
+		{"valid", `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "tags": ["2018.03", "v1.0_rc-1"]}`, nil},
+		{"whole registry", `{"region": "us-west-2", "registry": "148658015984"}`, nil},
+		{"missing region and registry", `{"repository": "amazonlinux"}`, []string{"region", "registry"}},
+		{"unknown region", `{"region": "us-west-9", "registry": "148658015984", "repository": "amazonlinux"}`, []string{"region"}},
+		{"short registry", `{"region": "us-west-2", "registry": "14865801598", "repository": "amazonlinux"}`, []string{"registry"}},
+		{"registry with letters", `{"region": "us-west-2", "registry": "14865801598a", "repository": "amazonlinux"}`, []string{"registry"}},
+		{"short repository", `{"region": "us-west-2", "registry": "148658015984", "repository": "a"}`, []string{"repository"}},
+		{"uppercase repository", `{"region": "us-west-2", "registry": "148658015984", "repository": "Amazonlinux"}`, []string{"repository"}},
+		{"repository starting with a separator", `{"region": "us-west-2", "registry": "148658015984", "repository": "team/-api"}`, []string{"repository"}},
+		{"invalid tags", `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "tags": ["latest", ".hidden", "", "` + strings.Repeat("a", 129) + `"]}`,
+			[]string{"tags[1]", "tags[2]", "tags[3]"}},
+		{"invalid digest", `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "digests": ["sha256:abc"]}`, []string{"digests[0]"}},
+		{"negative limits", `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "latest": -1, "pushedWithinDays": -7}`,
+			[]string{"latest", "pushedWithinDays"}},
+		{"invalid snooze and schedule", `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "snoozeUntil": "tomorrow", "schedule": "every day"}`,
+			[]string{"snoozeUntil", "schedule"}},
+		{"all fields collected", `{"region": "mars-1", "registry": "ecr", "repository": "A", "tags": ["?"]}`,
+			[]string{"region", "registry", "repository", "tags[0]"}},
+		{"unknown field", `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "tag": ["latest"]}`, []string{"tag"}},
+		{"wrong type", `{"region": "us-west-2", "registry": "148658015984", "repository": "amazonlinux", "latest": "3"}`, []string{"latest"}},
+		{"malformed JSON", `{"region": "us-west-2",`, []string{""}},
+	}
+	for _, test := range tests {
+		ss := spec.ScanSpec{}
+		err := decodeScanSpec(test.payload, &ss)
+		if err == nil {
+			err = validateScanSpec(ss)
+		}
+		fields := []string{}
+		if ve, ok := err.(*ValidationError); ok {
+			for _, fe := range ve.Errors {
+				fields = append(fields, fe.Field)
+			}
+		} else if err != nil {
+			t.Fatalf("%v: returned %v, want a ValidationError", test.name, err)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.invalid, ",") || (len(fields) == 0) != (test.invalid == nil) {
+			t.Errorf("%v: invalid fields %q, want %q", test.name, fields, test.invalid)
+		}
+	}
+}
+
+func TestInvalidScanSpecResponse(t *testing.T) {
+	useFileStore(t)
+	resp := call(t, "POST", "", `{"region": "us-west-9", "registry": "148658015984", "repository": "amazonlinux", "tags": [".hidden"]}`, "")
+	if resp.StatusCode != http.StatusBadRequest || resp.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("status %v, content type %v, want a JSON client error", resp.StatusCode, resp.Headers["Content-Type"])
+	}
+	ve := ValidationError{}
+	if err := json.Unmarshal([]byte(resp.Body), &ve); err != nil {
+		t.Fatalf("body %v isn't JSON: %v", resp.Body, err)
+	}
+	if len(ve.Errors) != 2 || ve.Errors[0].Field != "region" || ve.Errors[1].Field != "tags[0]" || ve.Errors[0].Message == "" {
+		t.Errorf("body %v, want the errors of region and tags[0]", resp.Body)
+	}
+	if ids, err := store.IDs(context.Background()); err != nil || len(ids) != 0 {
+		t.Errorf("stored %v, %v after the client error", ids, err)
+	}
+}
@@ -0,0 +1,128 @@
+// Package ecrclient builds the ECR clients the functions call ECR with,
+// using the credentials of the role a scan spec names, if any, for
+// repositories in other accounts. Clients are cached per region and role for
+// the lifetime of the process, so warm Lambda invocations reuse them.
+package ecrclient
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"ecr.amazon.com/spec"
+)
+
+// sessionName identifies the scanner in the CloudTrail logs of the
+// accounts whose roles it assumes
+const sessionName = "ecr-continuous-scan"
+
+// API is the part of the ECR API the functions call, as implemented by the
+// ECR client. Every call takes the context of the Lambda invocation, so
+// that requests in flight are cancelled once its deadline passes.
+type API interface {
+	DescribeRepositories(ctx context.Context, params *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error)
+	DescribeImages(ctx context.Context, params *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error)
+	StartImageScan(ctx context.Context, params *ecr.StartImageScanInput, optFns ...func(*ecr.Options)) (*ecr.StartImageScanOutput, error)
+	DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error)
+}
+
+// Role is the IAM role to assume for calling ECR, the zero Role means the
+// credentials of the function itself
+type Role struct {
+	ARN        string `json:"roleArn,omitempty"`
+	ExternalID string `json:"externalId,omitempty"`
+}
+
+// RoleOf returns the role the scan spec asks to assume
+func RoleOf(scanspec spec.ScanSpec) Role {
+	return Role{ARN: scanspec.RoleARN, ExternalID: scanspec.ExternalID}
+}
+
+// clientKey identifies a cached client
+type clientKey struct {
+	region string
+	role   Role
+}
+
+var (
+	mu sync.Mutex
+	// base is the configuration all clients derive from, loaded on first use
+	base *aws.Config
+	// assumed caches the credentials per role, so that scan specs in the
+	// same account share them and they're only refreshed once expired
+	assumed = map[Role]aws.CredentialsProvider{}
+	// clients caches the ECR clients per region and role
+	clients = map[clientKey]*ecr.Client{}
+	// endpointURL sends the ECR and STS calls to the given URL instead of
+	// the AWS endpoints if set, replaceable for tests
+	endpointURL = ""
+)
+
+// baseConfig returns the configuration the clients derive from, mu must be
+// held. Retries are left to the retry package.
+func baseConfig(ctx context.Context) (aws.Config, error) {
+	if base == nil {
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryer(func() aws.Retryer {
+			return aws.NopRetryer{}
+		}))
+		if err != nil {
+			return aws.Config{}, err
+		}
+		if endpointURL != "" {
+			cfg.EndpointResolver = aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+				return aws.Endpoint{URL: endpointURL, SigningRegion: region}, nil
+			})
+		}
+		base = &cfg
+	}
+	return *base, nil
+}
+
+// credentialsFor returns the cached credentials of the role, creating them
+// with an STS client for the given configuration if needed, mu must be held
+func credentialsFor(role Role, cfg aws.Config) aws.CredentialsProvider {
+	if creds, ok := assumed[role]; ok {
+		return creds
+	}
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role.ARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = sessionName
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+	})
+	creds := aws.NewCredentialsCache(provider)
+	assumed[role] = creds
+	return creds
+}
+
+// New returns the ECR client for the region, assuming the role unless it's
+// the zero Role
+func New(ctx context.Context, region string, role Role) (API, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	key := clientKey{region: region, role: role}
+	if svc, ok := clients[key]; ok {
+		return svc, nil
+	}
+	cfg, err := baseConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Region = region
+	if role.ARN != "" {
+		cfg.Credentials = credentialsFor(role, cfg)
+	}
+	svc := ecr.NewFromConfig(cfg)
+	clients[key] = svc
+	return svc, nil
+}
+
+// ForSpec returns the ECR client for the region and role of the scan spec
+func ForSpec(ctx context.Context, scanspec spec.ScanSpec) (API, error) {
+	return New(ctx, scanspec.Region, RoleOf(scanspec))
+}
@@ -0,0 +1,178 @@
+package ecrclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/ecr-continuous-scan-reader/ecr-continuous-scan</Arn>
+      <AssumedRoleId>AROAEXAMPLE:ecr-continuous-scan</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+  <ResponseMetadata>
+    <RequestId>c6104cbe-af31-11e0-8154-cbc7ccf896c7</RequestId>
+  </ResponseMetadata>
+</AssumeRoleResponse>`
+
+// stubAWS answers DescribeRepositories and AssumeRole calls, counting them
+type stubAWS struct {
+	ecrCalls int64
+	stsCalls int64
+}
+
+func (stub *stubAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".DescribeRepositories") {
+		atomic.AddInt64(&stub.ecrCalls, 1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"repositories":[{"repositoryName":"amazonlinux","registryId":"123456789012"}]}`)
+		return
+	}
+	if err := r.ParseForm(); err == nil && r.Form.Get("Action") == "AssumeRole" {
+		atomic.AddInt64(&stub.stsCalls, 1)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, assumeRoleResponse)
+		return
+	}
+	http.Error(w, "unexpected call", http.StatusBadRequest)
+}
+
+// useStub points the clients at the stub with static credentials, and
+// returns a function restoring the environment and the endpoint
+func useStub(stub *stubAWS) func() {
+	server := httptest.NewServer(stub)
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY":       "secret",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_REGION":                  "us-west-2",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+		"AWS_PROFILE":                 "",
+	}
+	saved := map[string]string{}
+	for name, value := range env {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = old
+		}
+		os.Setenv(name, value)
+	}
+	endpointURL = server.URL
+	reset()
+	return func() {
+		reset()
+		endpointURL = ""
+		for name := range env {
+			if old, ok := saved[name]; ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+		server.Close()
+	}
+}
+
+// reset drops the cached configuration, credentials and clients
+func reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	base = nil
+	assumed = map[Role]aws.CredentialsProvider{}
+	clients = map[clientKey]*ecr.Client{}
+}
+
+func describe(ctx context.Context, role Role) error {
+	svc, err := New(ctx, "us-west-2", role)
+	if err != nil {
+		return err
+	}
+	out, err := svc.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{})
+	if err != nil {
+		return err
+	}
+	if len(out.Repositories) != 1 {
+		return fmt.Errorf("got %v repositories, want 1", len(out.Repositories))
+	}
+	return nil
+}
+
+func TestNewCachesClients(t *testing.T) {
+	stub := &stubAWS{}
+	defer useStub(stub)()
+	ctx := context.Background()
+	role := Role{ARN: "arn:aws:iam::123456789012:role/ecr-continuous-scan-reader", ExternalID: "scan"}
+	for i := 0; i < 3; i++ {
+		if err := describe(ctx, Role{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := describe(ctx, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.ecrCalls != 6 || stub.stsCalls != 1 {
+		t.Errorf("made %v ECR and %v STS calls, want 6 and 1", stub.ecrCalls, stub.stsCalls)
+	}
+	first, _ := New(ctx, "us-west-2", role)
+	second, _ := New(ctx, "us-west-2", role)
+	other, _ := New(ctx, "eu-west-1", role)
+	if first != second || first == other {
+		t.Error("clients aren't cached per region and role")
+	}
+}
+
+// BenchmarkNew measures a call through a client created on the first call,
+// loading the configuration and assuming the role, against one reused by
+// warm invocations
+func BenchmarkNew(b *testing.B) {
+	stub := &stubAWS{}
+	defer useStub(stub)()
+	ctx := context.Background()
+	roles := []struct {
+		name string
+		role Role
+	}{
+		{"own", Role{}},
+		{"assumed", Role{ARN: "arn:aws:iam::123456789012:role/ecr-continuous-scan-reader"}},
+	}
+	for _, r := range roles {
+		name, role := r.name, r.role
+		b.Run("cold/"+name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				reset()
+				if err := describe(ctx, role); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("warm/"+name, func(b *testing.B) {
+			reset()
+			if err := describe(ctx, role); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := describe(ctx, role); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -4,10 +4,17 @@ go 1.16
 
 require (
 	github.com/aws/aws-lambda-go v1.26.0
-	github.com/aws/aws-sdk-go v1.40.25
+	github.com/aws/aws-sdk-go-v2 v1.9.0
 	github.com/aws/aws-sdk-go-v2/config v1.6.0
+	github.com/aws/aws-sdk-go-v2/credentials v1.3.2
+	github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue v1.2.0
 	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.4.0
+	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.5.0
+	github.com/aws/aws-sdk-go-v2/service/ecr v1.5.0
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.12.0
+	github.com/aws/aws-sdk-go-v2/service/sqs v1.0.0
+	github.com/aws/aws-sdk-go-v2/service/sts v1.6.1
+	github.com/aws/smithy-go v1.8.0
 	github.com/gorilla/feeds v1.1.1
 	github.com/kr/pretty v0.3.0 // indirect
 	github.com/satori/go.uuid v1.2.0
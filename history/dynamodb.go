@@ -0,0 +1,191 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"ecr.amazon.com/internal/store"
+	"ecr.amazon.com/retry"
+)
+
+// DynamoDBStore keeps each run record as an item in a table with the
+// string partition key "id", and each part as an item with the ID
+// <run ID>/<scan spec ID>
+type DynamoDBStore struct {
+	client *dynamodb.Client
+	table  string
+	policy retry.Policy
+}
+
+// NewDynamoDBStore returns a store for the run records in the given table
+func NewDynamoDBStore(ctx context.Context, table string) (*DynamoDBStore, error) {
+	if table == "" {
+		return nil, fmt.Errorf("no scan history table provided")
+	}
+	cfg, err := store.LoadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamoDBStore{
+		client: dynamodb.NewFromConfig(cfg),
+		table:  table,
+		policy: retry.FromEnv(),
+	}, nil
+}
+
+// the attribute names follow the JSON field names of Run
+func jsonTagKey(o *attributevalue.EncoderOptions)    { o.TagKey = "json" }
+func jsonTagKeyDec(o *attributevalue.DecoderOptions) { o.TagKey = "json" }
+
+func (st *DynamoDBStore) key(runid string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: runid},
+	}
+}
+
+func partID(runid string, specid string) string {
+	return runid + "/" + specid
+}
+
+// Store puts the run record into the table
+func (st *DynamoDBStore) Store(ctx context.Context, run Run) error {
+	return st.put(ctx, run.ID, run)
+}
+
+// Fetch reads the run record with the given ID from the table
+func (st *DynamoDBStore) Fetch(ctx context.Context, runid string) (Run, error) {
+	run := Run{}
+	err := st.get(ctx, runid, &run)
+	return run, err
+}
+
+// StorePart puts the part into the table, after setting its summary on the
+// run record in place, so that concurrent workers don't overwrite each other
+func (st *DynamoDBStore) StorePart(ctx context.Context, part Part) error {
+	summary, err := attributevalue.NewEncoder(jsonTagKey).Encode(part.Summary())
+	if err != nil {
+		return err
+	}
+	err = st.policy.Do(ctx, func() error {
+		_, err := st.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(st.table),
+			Key:                 st.key(part.RunID),
+			UpdateExpression:    aws.String("SET parts.#spec = :summary"),
+			ConditionExpression: aws.String("attribute_exists(id)"),
+			ExpressionAttributeNames: map[string]string{
+				"#spec": part.SpecID,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":summary": summary,
+			},
+		})
+		return err
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return st.put(ctx, partID(part.RunID, part.SpecID), part)
+}
+
+// FetchPart reads the part of the run for the given scan spec from the table
+func (st *DynamoDBStore) FetchPart(ctx context.Context, runid string, specid string) (Part, error) {
+	part := Part{}
+	err := st.get(ctx, partID(runid, specid), &part)
+	return part, err
+}
+
+// put stores v as the item with the given ID
+func (st *DynamoDBStore) put(ctx context.Context, id string, v interface{}) error {
+	av, err := attributevalue.NewEncoder(jsonTagKey).Encode(v)
+	if err != nil {
+		return err
+	}
+	item, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return fmt.Errorf("can't store %v as DynamoDB item", id)
+	}
+	item.Value["id"] = &types.AttributeValueMemberS{Value: id}
+	return st.policy.Do(ctx, func() error {
+		_, err := st.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(st.table),
+			Item:      item.Value,
+		})
+		return err
+	})
+}
+
+// get decodes the item with the given ID into v, returning ErrNotFound if
+// there is none. The read is consistent, so that a redelivered message
+// sees the part its first delivery stored.
+func (st *DynamoDBStore) get(ctx context.Context, id string, v interface{}) error {
+	var resp *dynamodb.GetItemOutput
+	err := st.policy.Do(ctx, func() error {
+		var err error
+		resp, err = st.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(st.table),
+			Key:            st.key(id),
+			ConsistentRead: aws.Bool(true),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Item == nil {
+		return ErrNotFound
+	}
+	return attributevalue.NewDecoder(jsonTagKeyDec).Decode(&types.AttributeValueMemberM{Value: resp.Item}, v)
+}
+
+// Page scans the table for up to limit run IDs, ordered within the page
+// only. As parts are skipped, a page may hold fewer IDs than limit even if
+// there are more. The cursor wraps the ID of the last evaluated item.
+func (st *DynamoDBStore) Page(ctx context.Context, limit int, cursor string) ([]string, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(st.table),
+		ProjectionExpression: aws.String("id"),
+	}
+	if limit > 0 {
+		input.Limit = aws.Int32(int32(limit))
+	}
+	if cursor != "" {
+		lastID, err := store.DecodeCursor(cursor, ErrInvalidCursor)
+		if err != nil {
+			return nil, "", err
+		}
+		input.ExclusiveStartKey = st.key(lastID)
+	}
+	var resp *dynamodb.ScanOutput
+	err := st.policy.Do(ctx, func() error {
+		var err error
+		resp, err = st.client.Scan(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	ids := []string{}
+	for _, item := range resp.Items {
+		if id, ok := item["id"].(*types.AttributeValueMemberS); ok && !strings.Contains(id.Value, "/") {
+			ids = append(ids, id.Value)
+		}
+	}
+	sort.Strings(ids)
+	lastID, ok := resp.LastEvaluatedKey["id"].(*types.AttributeValueMemberS)
+	if !ok {
+		return ids, "", nil
+	}
+	return ids, store.EncodeCursor(lastID.Value), nil
+}
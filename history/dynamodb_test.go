@@ -0,0 +1,52 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"ecr.amazon.com/retry"
+)
+
+// stubDynamoDB answers GetItem with a part, recording the requests
+type stubDynamoDB struct {
+	requests []map[string]interface{}
+}
+
+func (stub *stubDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	request := map[string]interface{}{}
+	json.Unmarshal(body, &request)
+	stub.requests = append(stub.requests, request)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Write([]byte(`{"Item": {"id": {"S": "run/app"}, "run": {"S": "run"}, "spec": {"S": "app"}, "finished": {"S": "1792000000"}}}`))
+}
+
+func TestDynamoDBFetchPartIsConsistent(t *testing.T) {
+	stub := &stubDynamoDB{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-west-2",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: dynamodb.EndpointResolverFromURL(server.URL),
+		Retryer:          aws.NopRetryer{},
+		// the stub doesn't checksum its responses:
+		DisableValidateResponseChecksum: true,
+	})
+	st := &DynamoDBStore{client: client, table: "ecr-continuous-scan-history", policy: retry.Policy{MaxAttempts: 1}}
+	part, err := st.FetchPart(context.Background(), "run", "app")
+	if err != nil || part.EndTime != "1792000000" {
+		t.Fatalf("FetchPart = %+v, %v", part, err)
+	}
+	// a redelivered message has to see the part stored right before:
+	if len(stub.requests) != 1 || stub.requests[0]["ConsistentRead"] != true {
+		t.Errorf("requested %v, want a consistent read", stub.requests)
+	}
+}
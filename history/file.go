@@ -0,0 +1,172 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"ecr.amazon.com/internal/store"
+)
+
+// FileStore keeps each run record as a JSON file named after its ID in a
+// local directory
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store for the run records in the given directory,
+// creating it if necessary
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no scan history directory provided")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (st *FileStore) path(runid string) string {
+	return filepath.Join(st.dir, filepath.Base(runid)+".json")
+}
+
+// partPath returns the path of a part, in a subdirectory named after the run
+func (st *FileStore) partPath(runid string, specid string) string {
+	return filepath.Join(st.dir, filepath.Base(runid), filepath.Base(specid)+".json")
+}
+
+// Store writes the run record to its file
+func (st *FileStore) Store(ctx context.Context, run Run) error {
+	return writeJSON(st.path(run.ID), run)
+}
+
+// StorePart writes the part to its file in the directory of the run, after
+// setting its summary on the run record under the lock of the run
+func (st *FileStore) StorePart(ctx context.Context, part Part) error {
+	err := st.summarize(ctx, part)
+	if err != nil {
+		return err
+	}
+	path := st.partPath(part.RunID, part.SpecID)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return writeJSON(path, part)
+}
+
+// summarize sets the summary of the part on its run record
+func (st *FileStore) summarize(ctx context.Context, part Part) error {
+	unlock, err := store.Lock(ctx, st.dir, part.RunID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	run, err := st.Fetch(ctx, part.RunID)
+	if err != nil {
+		return err
+	}
+	if run.Parts == nil {
+		run.Parts = map[string]PartSummary{}
+	}
+	run.Parts[part.SpecID] = part.Summary()
+	return st.Store(ctx, run)
+}
+
+// writeJSON writes v to the file at path, through a temporary file so that
+// readers never see a partial record
+func writeJSON(path string, v interface{}) error {
+	vjson, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".run-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(vjson)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Fetch reads the run record with the given ID from its file
+func (st *FileStore) Fetch(ctx context.Context, runid string) (Run, error) {
+	run := Run{}
+	runjson, err := ioutil.ReadFile(st.path(runid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return run, ErrNotFound
+		}
+		return run, err
+	}
+	err = json.Unmarshal(runjson, &run)
+	if err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// FetchPart reads the part of the run for the given scan spec from its file
+func (st *FileStore) FetchPart(ctx context.Context, runid string, specid string) (Part, error) {
+	part := Part{}
+	partjson, err := ioutil.ReadFile(st.partPath(runid, specid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return part, ErrNotFound
+		}
+		return part, err
+	}
+	err = json.Unmarshal(partjson, &part)
+	if err != nil {
+		return part, err
+	}
+	return part, nil
+}
+
+// Page lists up to limit run record files in the directory, ordered by
+// name and so newest first. The cursor wraps the last ID returned.
+func (st *FileStore) Page(ctx context.Context, limit int, cursor string) ([]string, string, error) {
+	lastID := ""
+	if cursor != "" {
+		var err error
+		lastID, err = store.DecodeCursor(cursor, ErrInvalidCursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	entries, err := ioutil.ReadDir(st.dir)
+	if err != nil {
+		return nil, "", err
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		fn := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(fn, ".") || !strings.HasSuffix(fn, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(fn, ".json"))
+	}
+	sort.Strings(ids)
+	start := sort.SearchStrings(ids, lastID)
+	if start < len(ids) && ids[start] == lastID {
+		start++
+	}
+	ids = ids[start:]
+	if limit <= 0 || len(ids) <= limit {
+		return ids, "", nil
+	}
+	ids = ids[:limit]
+	return ids, store.EncodeCursor(ids[limit-1]), nil
+}
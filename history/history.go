@@ -0,0 +1,284 @@
+// Package history records what each scan run did, so that runs can be
+// browsed after the fact.
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Status is the outcome of scanning a single target
+type Status string
+
+const (
+	// StatusStarted means the image scan was started
+	StatusStarted Status = "started"
+	// StatusSkippedRecentlyScanned means the image was scanned within the
+	// last 24 hours, so ECR refused another scan, or within the freshness
+	// window, so the scan wasn't started
+	StatusSkippedRecentlyScanned Status = "skipped-recently-scanned"
+	// StatusNotFound means the scan spec, repository or image doesn't exist
+	StatusNotFound Status = "not-found"
+	// StatusThrottled means the ECR API throttled the request
+	StatusThrottled Status = "throttled"
+	// StatusFailed means the scan failed for any other reason
+	StatusFailed Status = "failed"
+)
+
+// TargetResult is the outcome of scanning a single image or, if the images
+// of a scan spec couldn't be determined, of the scan spec as a whole
+type TargetResult struct {
+	// SpecID is the ID of the scan spec the target belongs to
+	SpecID string `json:"spec"`
+	// Region is the region of the repository
+	Region string `json:"region,omitempty"`
+	// Repository is the repository name
+	Repository string `json:"repository,omitempty"`
+	// Image names the tags and digest of the image, empty for a scan spec
+	// level result
+	Image string `json:"image,omitempty"`
+	// Status is the outcome of the scan
+	Status Status `json:"status"`
+	// Error is the error message for any status other than started
+	Error string `json:"error,omitempty"`
+	// ScanStatus is the image scan status ECR reported for a started scan
+	ScanStatus string `json:"scanStatus,omitempty"`
+	// ScanStatusDescription is the description ECR gave for the scan status
+	ScanStatusDescription string `json:"scanStatusDescription,omitempty"`
+}
+
+// Run is the record of a single scan run
+type Run struct {
+	// ID is a unique identifier for the run, starting with the seconds from
+	// the UTC start time to idEpoch so that runs are listed newest first,
+	// followed by the start time itself for readability
+	ID string `json:"id"`
+	// StartTime is the UTC timestamp of when the run started
+	StartTime string `json:"started"`
+	// EndTime is the UTC timestamp of when the run finished
+	EndTime string `json:"finished"`
+	// Specs are the IDs of the scan specs processed in the run
+	Specs []string `json:"specs"`
+	// Results holds the outcome per target
+	Results []TargetResult `json:"results"`
+	// LimiterWait is the time in milliseconds the run waited for the
+	// client-side rate limiter, per region
+	LimiterWait map[string]int64 `json:"limiterWaitMs,omitempty"`
+	// Parts summarizes the parts stored so far per scan spec ID, kept up to
+	// date by StorePart so that runs can be listed without their parts
+	Parts map[string]PartSummary `json:"parts"`
+}
+
+// PartSummary is the overview of a part kept on the run record
+type PartSummary struct {
+	// EndTime is the UTC timestamp of when the worker finished
+	EndTime string `json:"finished"`
+	// Counts is the number of targets of the part per status
+	Counts map[Status]int `json:"counts"`
+	// LimiterWait is the time in milliseconds the worker waited for the
+	// client-side rate limiter, per region
+	LimiterWait map[string]int64 `json:"limiterWaitMs,omitempty"`
+}
+
+// Part is the record of the work done for a single scan spec of a run,
+// stored by the worker that processed the scan spec
+type Part struct {
+	// RunID is the ID of the run the part belongs to
+	RunID string `json:"run"`
+	// SpecID is the ID of the scan spec processed
+	SpecID string `json:"spec"`
+	// EndTime is the UTC timestamp of when the worker finished
+	EndTime string `json:"finished"`
+	// Results holds the outcome per target of the scan spec
+	Results []TargetResult `json:"results"`
+	// LimiterWait is the time in milliseconds the worker waited for the
+	// client-side rate limiter, per region
+	LimiterWait map[string]int64 `json:"limiterWaitMs,omitempty"`
+}
+
+// Summary is the overview of a run returned when listing runs
+type Summary struct {
+	ID        string         `json:"id"`
+	StartTime string         `json:"started"`
+	EndTime   string         `json:"finished"`
+	Specs     int            `json:"specs"`
+	Targets   int            `json:"targets"`
+	Counts    map[Status]int `json:"counts"`
+	// LimiterWait is the total time in milliseconds the run waited for the
+	// client-side rate limiter
+	LimiterWait int64 `json:"limiterWaitMs"`
+}
+
+// idEpoch is the time run IDs count down to, 2200-01-01T00:00:00Z in
+// seconds since the Unix epoch
+const idEpoch = 7258118400
+
+// NewRun returns a run record starting at the given time
+func NewRun(start time.Time) Run {
+	countdown := fmt.Sprintf("%010d", idEpoch-start.Unix())
+	return Run{
+		ID:        countdown + "-" + start.UTC().Format("20060102T150405Z") + "-" + uuid.NewV4().String(),
+		StartTime: fmt.Sprintf("%v", start.Unix()),
+		Specs:     []string{},
+		Results:   []TargetResult{},
+		Parts:     map[string]PartSummary{},
+	}
+}
+
+// merge adds the results and limiter wait of the part to the run, and
+// moves the end of the run to the end of the part if that's later
+func (run *Run) merge(part Part) {
+	run.Results = append(run.Results, part.Results...)
+	if run.Parts == nil {
+		run.Parts = map[string]PartSummary{}
+	}
+	run.Parts[part.SpecID] = part.Summary()
+	for region, ms := range part.LimiterWait {
+		if run.LimiterWait == nil {
+			run.LimiterWait = map[string]int64{}
+		}
+		run.LimiterWait[region] += ms
+	}
+	end, _ := strconv.ParseInt(run.EndTime, 10, 64)
+	if partEnd, err := strconv.ParseInt(part.EndTime, 10, 64); err == nil && partEnd > end {
+		run.EndTime = part.EndTime
+	}
+}
+
+// Counts returns the number of targets per status
+func (run Run) Counts() map[Status]int {
+	return countResults(run.Results)
+}
+
+// Counts returns the number of targets of the part per status
+func (part Part) Counts() map[Status]int {
+	return countResults(part.Results)
+}
+
+func countResults(results []TargetResult) map[Status]int {
+	counts := map[Status]int{}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	return counts
+}
+
+// Summary returns the overview of the part
+func (part Part) Summary() PartSummary {
+	return PartSummary{
+		EndTime:     part.EndTime,
+		Counts:      part.Counts(),
+		LimiterWait: part.LimiterWait,
+	}
+}
+
+// Summary returns the overview of the run from its part summaries and the
+// results of scan specs without a part, such as those that failed to load,
+// so that it's the same whether or not the parts were merged in
+func (run Run) Summary() Summary {
+	summary := Summary{
+		ID:        run.ID,
+		StartTime: run.StartTime,
+		EndTime:   run.EndTime,
+		Specs:     len(run.Specs),
+		Counts:    map[Status]int{},
+	}
+	for _, result := range run.Results {
+		if _, ok := run.Parts[result.SpecID]; !ok {
+			summary.Counts[result.Status]++
+			summary.Targets++
+		}
+	}
+	end, _ := strconv.ParseInt(summary.EndTime, 10, 64)
+	for _, part := range run.Parts {
+		for status, count := range part.Counts {
+			summary.Counts[status] += count
+			summary.Targets += count
+		}
+		// the dispatcher never waits for the limiter, only the workers do:
+		for _, ms := range part.LimiterWait {
+			summary.LimiterWait += ms
+		}
+		if partEnd, err := strconv.ParseInt(part.EndTime, 10, 64); err == nil && partEnd > end {
+			end = partEnd
+			summary.EndTime = part.EndTime
+		}
+	}
+	return summary
+}
+
+// ErrNotFound is returned by a RunStore if no run with the requested ID exists
+var ErrNotFound = errors.New("scan run not found")
+
+// ErrInvalidCursor is returned by a RunStore if the cursor passed to Page
+// wasn't issued by that store
+var ErrInvalidCursor = errors.New("invalid scan run cursor")
+
+// RunStore persists run records, keyed by their ID, and the parts of the
+// runs, keyed by run and scan spec ID
+type RunStore interface {
+	// Store creates or overwrites the run record
+	Store(ctx context.Context, run Run) error
+	// Fetch returns the run record with the given ID or ErrNotFound,
+	// without its parts
+	Fetch(ctx context.Context, runid string) (Run, error)
+	// StorePart creates or overwrites the part of a run, after updating its
+	// summary on the run record, which has to exist
+	StorePart(ctx context.Context, part Part) error
+	// FetchPart returns the part of the run for the given scan spec or
+	// ErrNotFound if no worker stored it yet
+	FetchPart(ctx context.Context, runid string, specid string) (Part, error)
+	// Page returns up to limit run IDs, starting at the given cursor. The
+	// S3 and file stores return them newest first, as the IDs sort that way.
+	// The returned cursor is empty once all IDs have been returned.
+	Page(ctx context.Context, limit int, cursor string) ([]string, string, error)
+}
+
+// Load returns the run record with the given ID, with the parts stored so
+// far for its scan specs merged in
+func Load(ctx context.Context, st RunStore, runid string) (Run, error) {
+	run, err := st.Fetch(ctx, runid)
+	if err != nil {
+		return run, err
+	}
+	for _, specid := range run.Specs {
+		part, err := st.FetchPart(ctx, runid, specid)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return run, fmt.Errorf("can't load part %v of scan run %v: %w", specid, runid, err)
+		}
+		run.merge(part)
+	}
+	return run, nil
+}
+
+// NewFromEnv returns the RunStore for the backend selected by the
+// ECR_SCAN_SPEC_STORE environment variable, so that run records are kept
+// next to the scan specs: under the runs/ prefix of ECR_SCAN_CONFIG_BUCKET,
+// in the table ECR_SCAN_HISTORY_TABLE, or in the runs subdirectory of
+// ECR_SCAN_CONFIG_DIR.
+func NewFromEnv(ctx context.Context) (RunStore, error) {
+	switch kind := os.Getenv("ECR_SCAN_SPEC_STORE"); kind {
+	case "", "s3":
+		return NewS3Store(ctx, os.Getenv("ECR_SCAN_CONFIG_BUCKET"))
+	case "dynamodb":
+		return NewDynamoDBStore(ctx, os.Getenv("ECR_SCAN_HISTORY_TABLE"))
+	case "file":
+		dir := os.Getenv("ECR_SCAN_CONFIG_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("no scan config directory provided")
+		}
+		return NewFileStore(filepath.Join(dir, "runs"))
+	default:
+		return nil, fmt.Errorf("unknown scan spec store %q", kind)
+	}
+}
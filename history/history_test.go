@@ -0,0 +1,118 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRunIDsSortNewestFirst(t *testing.T) {
+	start := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	ids := []string{}
+	for _, offset := range []time.Duration{0, time.Second, time.Hour, 24 * time.Hour, 400 * 24 * time.Hour} {
+		ids = append(ids, NewRun(start.Add(offset)).ID)
+	}
+	if !sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] > ids[j] }) {
+		t.Errorf("run IDs %v don't sort newest first", ids)
+	}
+
+	st, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, id := range ids {
+		if err := st.Store(ctx, Run{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listed := []string{}
+	cursor := ""
+	for {
+		page, next, err := st.Page(ctx, 2, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed = append(listed, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	for i := range ids {
+		if i >= len(listed) || listed[i] != ids[len(ids)-1-i] {
+			t.Fatalf("listed %v, want newest first %v", listed, ids)
+		}
+	}
+}
+
+func TestSummaryWithoutParts(t *testing.T) {
+	st, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	run := NewRun(time.Unix(1792000000, 0))
+	run.Specs = []string{"a", "b", "c"}
+	// a scan spec that failed to load is recorded by the dispatcher:
+	run.Results = append(run.Results, TargetResult{SpecID: "broken", Status: StatusFailed})
+	if err := st.Store(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	parts := []Part{
+		{RunID: run.ID, SpecID: "a", EndTime: "1792000060", LimiterWait: map[string]int64{"us-west-2": 150}, Results: []TargetResult{
+			{SpecID: "a", Status: StatusStarted},
+			{SpecID: "a", Status: StatusStarted},
+			{SpecID: "a", Status: StatusThrottled},
+		}},
+		{RunID: run.ID, SpecID: "b", EndTime: "1792000090", LimiterWait: map[string]int64{"us-west-2": 50, "eu-west-1": 25}, Results: []TargetResult{
+			{SpecID: "b", Status: StatusNotFound},
+		}},
+	}
+	errs := make(chan error, len(parts))
+	for _, part := range parts {
+		go func(part Part) { errs <- st.StorePart(ctx, part) }(part)
+	}
+	for range parts {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a follow-up overwrites the part and its summary:
+	parts[0].Results[2].Status = StatusStarted
+	if err := st.StorePart(ctx, parts[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched, err := st.Fetch(ctx, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(ctx, st, run.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Summary{
+		ID:          run.ID,
+		StartTime:   "1792000000",
+		EndTime:     "1792000090",
+		Specs:       3,
+		Targets:     5,
+		Counts:      map[Status]int{StatusStarted: 3, StatusNotFound: 1, StatusFailed: 1},
+		LimiterWait: 225,
+	}
+	for name, got := range map[string]Summary{"fetched": fetched.Summary(), "loaded": loaded.Summary()} {
+		if got.ID != want.ID || got.StartTime != want.StartTime || got.EndTime != want.EndTime || got.Specs != want.Specs ||
+			got.Targets != want.Targets || got.LimiterWait != want.LimiterWait || fmt.Sprint(got.Counts) != fmt.Sprint(want.Counts) {
+			t.Errorf("%v run has summary %+v, want %+v", name, got, want)
+		}
+	}
+
+	orphan := Part{RunID: "missing", SpecID: "a", Results: []TargetResult{}}
+	if err := st.StorePart(ctx, orphan); !errors.Is(err, ErrNotFound) {
+		t.Errorf("StorePart of a part without run returned %v, want ErrNotFound", err)
+	}
+}
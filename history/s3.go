@@ -0,0 +1,259 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"ecr.amazon.com/internal/store"
+	"ecr.amazon.com/retry"
+)
+
+const (
+	// prefix is the key prefix of the run records in the bucket
+	prefix = "runs/"
+	// maxSummaryAttempts is how often StorePart tries to update the run
+	// record while other workers update it concurrently
+	maxSummaryAttempts = 5
+)
+
+// errConflict means the run record changed since it was read
+var errConflict = errors.New("scan run changed concurrently")
+
+// S3Store keeps each run record as a JSON object under the runs/ prefix
+// of a bucket
+type S3Store struct {
+	client *s3.Client
+	bucket string
+	policy retry.Policy
+}
+
+// NewS3Store returns a store for the run records in the given bucket
+func NewS3Store(ctx context.Context, bucket string) (*S3Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("no scan config bucket provided")
+	}
+	cfg, err := store.LoadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{
+		client: s3.NewFromConfig(cfg),
+		bucket: bucket,
+		policy: retry.FromEnv(),
+	}, nil
+}
+
+func (st *S3Store) key(runid string) string {
+	return prefix + runid + ".json"
+}
+
+// partKey returns the key of a part, under a prefix named after the run
+func (st *S3Store) partKey(runid string, specid string) string {
+	return prefix + runid + "/" + specid + ".json"
+}
+
+// Store uploads the run record to the bucket
+func (st *S3Store) Store(ctx context.Context, run Run) error {
+	return st.upload(ctx, st.key(run.ID), run)
+}
+
+// Fetch downloads the run record with the given ID from the bucket
+func (st *S3Store) Fetch(ctx context.Context, runid string) (Run, error) {
+	run := Run{}
+	err := st.download(ctx, st.key(runid), &run)
+	return run, err
+}
+
+// StorePart uploads the part to the bucket, after updating its summary on
+// the run record
+func (st *S3Store) StorePart(ctx context.Context, part Part) error {
+	err := st.summarize(ctx, part)
+	if err != nil {
+		return err
+	}
+	return st.upload(ctx, st.partKey(part.RunID, part.SpecID), part)
+}
+
+// summarize sets the summary of the part on its run record, writing the
+// record conditionally on its ETag and starting over if another worker
+// updated it in between
+func (st *S3Store) summarize(ctx context.Context, part Part) error {
+	for attempt := 1; ; attempt++ {
+		run, etag, err := st.fetchTagged(ctx, part.RunID)
+		if err != nil {
+			return err
+		}
+		if run.Parts == nil {
+			run.Parts = map[string]PartSummary{}
+		}
+		run.Parts[part.SpecID] = part.Summary()
+		err = st.storeTagged(ctx, run, etag)
+		if !errors.Is(err, errConflict) || attempt >= maxSummaryAttempts {
+			return err
+		}
+		fmt.Printf("DEBUG:: scan run %v changed concurrently, summarizing part %v again\n", part.RunID, part.SpecID)
+	}
+}
+
+// fetchTagged downloads the run record with the given ID along with the
+// ETag of its object
+func (st *S3Store) fetchTagged(ctx context.Context, runid string) (Run, string, error) {
+	run := Run{}
+	var runjson []byte
+	etag := ""
+	err := st.policy.Do(ctx, func() error {
+		resp, err := st.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(st.key(runid)),
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		etag = aws.ToString(resp.ETag)
+		runjson, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return run, "", ErrNotFound
+		}
+		return run, "", err
+	}
+	err = json.Unmarshal(runjson, &run)
+	return run, etag, err
+}
+
+// storeTagged uploads the run record if its object still has the given
+// ETag, and returns errConflict otherwise
+func (st *S3Store) storeTagged(ctx context.Context, run Run, etag string) error {
+	runjson, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	err = st.policy.Do(ctx, func() error {
+		_, err := st.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(st.key(run.ID)),
+			Body:   bytes.NewReader(runjson),
+		}, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-Match", etag)))
+		return err
+	})
+	var re *smithyhttp.ResponseError
+	if errors.As(err, &re) && (re.HTTPStatusCode() == http.StatusPreconditionFailed || re.HTTPStatusCode() == http.StatusConflict) {
+		return errConflict
+	}
+	return err
+}
+
+// FetchPart downloads the part of the run for the given scan spec from the bucket
+func (st *S3Store) FetchPart(ctx context.Context, runid string, specid string) (Part, error) {
+	part := Part{}
+	err := st.download(ctx, st.partKey(runid, specid), &part)
+	return part, err
+}
+
+// upload stores v as JSON object under the given key
+func (st *S3Store) upload(ctx context.Context, key string, v interface{}) error {
+	vjson, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	uploader := manager.NewUploader(st.client)
+	return st.policy.Do(ctx, func() error {
+		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(vjson),
+		})
+		return err
+	})
+}
+
+// download decodes the JSON object under the given key into v, returning
+// ErrNotFound if there is none
+func (st *S3Store) download(ctx context.Context, key string, v interface{}) error {
+	downloader := manager.NewDownloader(st.client)
+	var buf *manager.WriteAtBuffer
+	err := st.policy.Do(ctx, func() error {
+		// start over with an empty buffer on every attempt:
+		buf = manager.NewWriteAtBuffer([]byte{})
+		_, err := downloader.Download(ctx, buf, &s3.GetObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return json.Unmarshal(buf.Bytes(), v)
+}
+
+// Page lists up to limit run records under the runs/ prefix, in key order
+// and so newest first. S3 counts the prefix holding the parts of each run
+// toward MaxKeys like a key, so Page keeps listing until it has one ID more
+// than limit, which also tells whether there is another page. The cursor
+// wraps the last ID returned, which the next page starts after.
+func (st *S3Store) Page(ctx context.Context, limit int, cursor string) ([]string, string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(st.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	if limit > 0 {
+		input.MaxKeys = int32(limit + 1)
+	}
+	if cursor != "" {
+		lastID, err := store.DecodeCursor(cursor, ErrInvalidCursor)
+		if err != nil {
+			return nil, "", err
+		}
+		input.StartAfter = aws.String(st.key(lastID))
+	}
+	ids := []string{}
+	for limit <= 0 || len(ids) <= limit {
+		var resp *s3.ListObjectsV2Output
+		err := st.policy.Do(ctx, func() error {
+			var err error
+			resp, err = st.client.ListObjectsV2(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		for _, obj := range resp.Contents {
+			fn := strings.TrimPrefix(aws.ToString(obj.Key), prefix)
+			if !strings.HasSuffix(fn, ".json") {
+				continue
+			}
+			ids = append(ids, strings.TrimSuffix(fn, ".json"))
+		}
+		if !resp.IsTruncated || resp.NextContinuationToken == nil {
+			break
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+	if limit <= 0 || len(ids) <= limit {
+		return ids, "", nil
+	}
+	ids = ids[:limit]
+	return ids, store.EncodeCursor(ids[limit-1]), nil
+}
@@ -0,0 +1,66 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"ecr.amazon.com/internal/s3test"
+	"ecr.amazon.com/retry"
+)
+
+// newStubS3Store returns an S3 store listing the keys from a stub
+func newStubS3Store(t *testing.T, keys []string) *S3Store {
+	client := s3test.NewListingClient(t, keys)
+	return &S3Store{client: client, bucket: "ecr-continuous-scan-config", policy: retry.Policy{MaxAttempts: 1}}
+}
+
+func TestS3PageSkipsParts(t *testing.T) {
+	start := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	ids := []string{}
+	keys := []string{"configs.json"}
+	st := newStubS3Store(t, nil)
+	for i := 0; i < 7; i++ {
+		id := NewRun(start.Add(time.Duration(i) * time.Hour)).ID
+		ids = append(ids, id)
+		keys = append(keys, st.key(id), st.partKey(id, "a"), st.partKey(id, "b"))
+	}
+	sort.Strings(ids)
+	st = newStubS3Store(t, keys)
+
+	ctx := context.Background()
+	for _, limit := range []int{1, 2, 3, 7, 10} {
+		listed := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(ids) {
+				t.Fatalf("limit %v: cursors don't end", limit)
+			}
+			page, next, err := st.Page(ctx, limit, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := len(ids) - len(listed)
+			if want > limit {
+				want = limit
+			}
+			if len(page) != want {
+				t.Errorf("limit %v: page %v has %v runs %v, want %v", limit, pages, len(page), page, want)
+			}
+			listed = append(listed, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if fmt.Sprint(listed) != fmt.Sprint(ids) {
+			t.Errorf("limit %v: listed %v, want %v", limit, listed, ids)
+		}
+	}
+
+	if _, _, err := st.Page(ctx, 2, "not a cursor!"); err != ErrInvalidCursor {
+		t.Errorf("Page with an invalid cursor returned %v, want ErrInvalidCursor", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Package s3test provides an S3 client answering from a stub server, for
+// testing the S3 stores without a bucket.
+package s3test
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// listResult is the ListObjectsV2 response body
+type listResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Contents              []listObject
+	CommonPrefixes        []listPrefix
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+type listObject struct {
+	Key string
+}
+
+type listPrefix struct {
+	Prefix string
+}
+
+// lister answers ListObjectsV2 for a fixed set of keys, counting common
+// prefixes toward max-keys like S3 does
+type lister struct {
+	keys []string
+}
+
+func (stub *lister) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		http.Error(w, "unexpected call", http.StatusBadRequest)
+		return
+	}
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := 1000
+	if raw := q.Get("max-keys"); raw != "" {
+		maxKeys, _ = strconv.Atoi(raw)
+	}
+	after := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		after = token
+	}
+	result := listResult{}
+	last := ""
+	for _, key := range stub.keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			rolled := key[:len(prefix)+i+len(delimiter)]
+			if rolled == last {
+				continue
+			}
+			if len(result.Contents)+len(result.CommonPrefixes) == maxKeys {
+				result.IsTruncated = true
+				break
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, listPrefix{Prefix: rolled})
+			last = rolled
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		result.Contents = append(result.Contents, listObject{Key: key})
+		last = key
+	}
+	if result.IsTruncated {
+		// keys under a rolled up prefix sort before the prefix plus 0xff:
+		result.NextContinuationToken = last
+		if strings.HasSuffix(last, delimiter) {
+			result.NextContinuationToken = last + "\xff"
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// NewListingClient returns an S3 client listing the given keys in any
+// bucket, from a stub server that is closed when the test ends
+func NewListingClient(t *testing.T, keys []string) *s3.Client {
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+	server := httptest.NewServer(&lister{keys: keys})
+	t.Cleanup(server.Close)
+	return s3.New(s3.Options{
+		Region:           "us-west-2",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: s3.EndpointResolverFromURL(server.URL),
+		UsePathStyle:     true,
+	})
+}
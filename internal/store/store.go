@@ -0,0 +1,72 @@
+// Package store holds what the scan spec and run stores have in common:
+// the AWS configuration of the S3 and DynamoDB stores, the lock files of
+// the file stores and the opaque cursors of all stores.
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// LoadConfig loads the default AWS configuration for the clients of the S3
+// and DynamoDB stores. The SDK doesn't retry their calls, as each store
+// retries them according to its own retry.Policy.
+func LoadConfig(ctx context.Context) (aws.Config, error) {
+	return config.LoadDefaultConfig(ctx, config.WithRetryer(func() aws.Retryer {
+		return aws.NopRetryer{}
+	}))
+}
+
+// staleLock is the age after which a lock file is taken to be left behind
+// by a writer that crashed
+const staleLock = 10 * time.Second
+
+// Lock creates the lock file of the record with the given ID in the
+// directory, waiting for other writers to remove theirs, and returns the
+// function removing it
+func Lock(ctx context.Context, dir string, id string) (func(), error) {
+	path := filepath.Join(dir, "."+filepath.Base(id)+".lock")
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// EncodeCursor turns a store-specific position into an opaque cursor
+func EncodeCursor(position string) string {
+	if position == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// DecodeCursor returns the store-specific position of an opaque cursor, or
+// the given error if it isn't one
+func DecodeCursor(cursor string, invalid error) (string, error) {
+	position, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", invalid
+	}
+	return string(position), nil
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	unlock, err := Lock(ctx, dir, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second writer waits until the context is done:
+	waiting, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := Lock(waiting, dir, "run"); err != context.DeadlineExceeded {
+		t.Errorf("locking a locked record returned %v, want the deadline exceeded", err)
+	}
+	unlock()
+	if _, err := Lock(ctx, dir, "run"); err != nil {
+		t.Fatalf("locking an unlocked record failed: %v", err)
+	}
+
+	// the lock of a writer that crashed is taken over once stale, even
+	// without time left to wait:
+	old := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(filepath.Join(dir, ".run.lock"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lock(waiting, dir, "run"); err != nil {
+		t.Errorf("locking a stale lock returned %v", err)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	invalid := errors.New("invalid cursor")
+	for _, position := range []string{"a", "2026-10-15/app", "runs/x.json"} {
+		if got, err := DecodeCursor(EncodeCursor(position), invalid); err != nil || got != position {
+			t.Errorf("cursor of %q decoded to %q, %v", position, got, err)
+		}
+	}
+	if EncodeCursor("") != "" {
+		t.Error("the cursor of the start isn't empty")
+	}
+	if _, err := DecodeCursor("not a cursor!", invalid); err != invalid {
+		t.Errorf("decoding an invalid cursor returned %v", err)
+	}
+}
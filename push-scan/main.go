@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"ecr.amazon.com/history"
+	"ecr.amazon.com/queue"
+	"ecr.amazon.com/scan"
+	"ecr.amazon.com/spec"
+)
+
+var (
+	store spec.SpecStore
+	runs  history.RunStore
+	q     queue.Queue
+)
+
+// handler dispatches a scan of the pushed image for every scan spec selecting
+// it, on ECR Image Action events. Pushes no scan spec selects are ignored.
+// With the in-memory queue, the messages are worked off right here.
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	fmt.Printf("DEBUG:: push event %v\n", event.ID)
+	push, ok, err := scan.PushFromEvent(event)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if !ok {
+		fmt.Printf("DEBUG:: ignoring %v event from %v, not a successful push\n", event.DetailType, event.Source)
+		return nil
+	}
+	run, err := scan.DispatchPush(ctx, store, runs, q, push, time.Now())
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	if len(run.Results) > 0 {
+		fmt.Printf("DEBUG:: %v scan specs failed to load in run %v\n", len(run.Results), run.ID)
+	}
+	if len(run.Specs) == 0 {
+		fmt.Printf("DEBUG:: no scan specs select %v:%v@%v\n", push.Repository, push.Tag, push.Digest)
+		return nil
+	}
+	fmt.Printf("DEBUG:: dispatched %v scan specs for %v:%v@%v in run %v\n", len(run.Specs), push.Repository, push.Tag, push.Digest, run.ID)
+	if mem, ok := q.(*queue.Memory); ok {
+		err = scan.WorkOff(ctx, mem, run)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	ctx := context.Background()
+	var err error
+	store, err = spec.NewFromEnv(ctx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	runs, err = history.NewFromEnv(ctx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	q, err = queue.NewFromEnv(ctx)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	lambda.Start(handler)
+}
@@ -0,0 +1,126 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMaxReceives is the number of times a message is delivered before
+// it's moved to the dead letters, matching the redrive policy of the SQS
+// queue in template.yaml
+const DefaultMaxReceives = 3
+
+// now and sleep are replaceable for deterministic runs
+var (
+	now   = time.Now
+	sleep = func(ctx context.Context, delay time.Duration) error {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+)
+
+// message is a message waiting in a Memory queue
+type message struct {
+	body     string
+	due      time.Time
+	receives int
+}
+
+// Memory is a queue within the process, for running the dispatcher and the
+// workers locally. Messages are only delivered by calling Drain.
+type Memory struct {
+	mu       sync.Mutex
+	messages []message
+	dead     []string
+}
+
+// NewMemory returns an empty in-memory queue
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send enqueues the message body, due after the given delay
+func (q *Memory) Send(ctx context.Context, body string, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, message{body: body, due: now().Add(delay)})
+	return nil
+}
+
+// SendBatch enqueues the message bodies, due right away
+func (q *Memory) SendBatch(ctx context.Context, bodies []string) []error {
+	errs := make([]error, len(bodies))
+	for i, body := range bodies {
+		errs[i] = q.Send(ctx, body, 0)
+	}
+	return errs
+}
+
+// Drain delivers the messages one at a time, earliest due first, until the
+// queue is empty or the context is done, including messages sent while
+// draining. A message the handler fails on is delivered again right away,
+// and moved to the dead letters after maxReceives deliveries.
+func (q *Memory) Drain(ctx context.Context, maxReceives int, handle func(ctx context.Context, body string) error) error {
+	for {
+		msg, ok := q.next()
+		if !ok {
+			return nil
+		}
+		if wait := msg.due.Sub(now()); wait > 0 {
+			if err := sleep(ctx, wait); err != nil {
+				q.requeue(msg)
+				return err
+			}
+		}
+		msg.receives++
+		err := handle(ctx, msg.body)
+		if err == nil {
+			continue
+		}
+		fmt.Printf("DEBUG:: delivery %v of message failed: %v\n", msg.receives, err)
+		if msg.receives >= maxReceives {
+			q.mu.Lock()
+			q.dead = append(q.dead, msg.body)
+			q.mu.Unlock()
+			continue
+		}
+		q.requeue(msg)
+	}
+}
+
+// DeadLetters returns the bodies of the messages that failed too often
+func (q *Memory) DeadLetters() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string{}, q.dead...)
+}
+
+// next removes and returns the message due first
+func (q *Memory) next() (message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.messages) == 0 {
+		return message{}, false
+	}
+	sort.SliceStable(q.messages, func(i, j int) bool {
+		return q.messages[i].due.Before(q.messages[j].due)
+	})
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	return msg, true
+}
+
+func (q *Memory) requeue(msg message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = append(q.messages, msg)
+}
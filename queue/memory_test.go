@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// useClock makes the queue run on a fake clock that sleeping advances, for
+// the duration of the test
+func useClock(t *testing.T) {
+	savedNow, savedSleep := now, sleep
+	clock := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	sleep = func(ctx context.Context, delay time.Duration) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		clock = clock.Add(delay)
+		return nil
+	}
+	t.Cleanup(func() { now, sleep = savedNow, savedSleep })
+}
+
+func TestDrainRedelivers(t *testing.T) {
+	useClock(t)
+	q := NewMemory()
+	ctx := context.Background()
+	for i, err := range q.SendBatch(ctx, []string{"flaky", "broken", "fine"}) {
+		if err != nil {
+			t.Errorf("sending message %v failed: %v", i, err)
+		}
+	}
+	delivered := []string{}
+	err := q.Drain(ctx, 3, func(ctx context.Context, body string) error {
+		delivered = append(delivered, body)
+		switch body {
+		case "broken":
+			return errors.New("broken")
+		case "flaky":
+			flakes := 0
+			for _, d := range delivered {
+				if d == "flaky" {
+					flakes++
+				}
+			}
+			if flakes < 2 {
+				return errors.New("flaky")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, body := range delivered {
+		counts[body]++
+	}
+	if counts["flaky"] != 2 || counts["broken"] != 3 || counts["fine"] != 1 {
+		t.Errorf("delivered %v, want flaky twice, broken 3 times and fine once", delivered)
+	}
+	if dead := q.DeadLetters(); fmt.Sprint(dead) != "[broken]" {
+		t.Errorf("dead letters %v, want the broken message", dead)
+	}
+	if _, ok := q.next(); ok {
+		t.Error("messages left after draining")
+	}
+}
+
+func TestDrainDelays(t *testing.T) {
+	useClock(t)
+	q := NewMemory()
+	ctx := context.Background()
+	start := now()
+	q.Send(ctx, "later", time.Minute)
+	q.Send(ctx, "now", 0)
+	delivered := []string{}
+	err := q.Drain(ctx, 1, func(ctx context.Context, body string) error {
+		delivered = append(delivered, fmt.Sprintf("%v@%v", body, now().Sub(start)))
+		// messages sent while draining are delivered too:
+		if body == "now" {
+			q.Send(ctx, "follow-up", 30*time.Second)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(delivered) != "[now@0s follow-up@30s later@1m0s]" {
+		t.Errorf("delivered %v, want each message once it's due", delivered)
+	}
+
+	// a message not due before the context is done stays in the queue:
+	q.Send(ctx, "too late", time.Hour)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := q.Drain(cancelled, 1, func(ctx context.Context, body string) error { return nil }); err != context.Canceled {
+		t.Errorf("draining after the context is done returned %v", err)
+	}
+	if msg, ok := q.next(); !ok || msg.body != "too late" || msg.receives != 0 {
+		t.Errorf("queue holds %+v, want the undelivered message", msg)
+	}
+}
@@ -0,0 +1,35 @@
+// Package queue carries scan work from the dispatcher to the workers, over
+// SQS when deployed and in memory for local runs.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Queue accepts messages for the workers
+type Queue interface {
+	// Send enqueues the message body, to be delivered no earlier than
+	// after the given delay
+	Send(ctx context.Context, body string, delay time.Duration) error
+	// SendBatch enqueues the message bodies for immediate delivery, in as
+	// few requests as possible. It returns an error per body, nil for the
+	// bodies that were enqueued.
+	SendBatch(ctx context.Context, bodies []string) []error
+}
+
+// NewFromEnv returns the Queue selected by the ECR_SCAN_QUEUE environment
+// variable: "sqs" (the default) for the SQS queue at ECR_SCAN_QUEUE_URL or
+// "memory" for a queue within the process
+func NewFromEnv(ctx context.Context) (Queue, error) {
+	switch kind := os.Getenv("ECR_SCAN_QUEUE"); kind {
+	case "", "sqs":
+		return NewSQS(ctx, os.Getenv("ECR_SCAN_QUEUE_URL"))
+	case "memory":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown scan queue %q", kind)
+	}
+}
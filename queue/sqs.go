@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"ecr.amazon.com/retry"
+)
+
+const (
+	// maxSQSDelay is the longest delivery delay SQS supports
+	maxSQSDelay = 15 * time.Minute
+	// maxSQSBatch is the number of messages SQS accepts per batch request
+	maxSQSBatch = 10
+)
+
+// SQS sends messages to an SQS queue, which delivers them to the worker
+// function and, once they failed too often, to its dead-letter queue
+type SQS struct {
+	client *sqs.Client
+	url    string
+	policy retry.Policy
+}
+
+// NewSQS returns a queue sending to the SQS queue with the given URL
+func NewSQS(ctx context.Context, url string) (*SQS, error) {
+	if url == "" {
+		return nil, fmt.Errorf("no scan queue URL provided")
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryer(func() aws.Retryer {
+		return aws.NopRetryer{}
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return &SQS{
+		client: sqs.NewFromConfig(cfg),
+		url:    url,
+		policy: retry.FromEnv(),
+	}, nil
+}
+
+// Send sends the message body to the queue, capping the delay at the 15
+// minutes SQS supports
+func (q *SQS) Send(ctx context.Context, body string, delay time.Duration) error {
+	if delay > maxSQSDelay {
+		delay = maxSQSDelay
+	}
+	return q.policy.Do(ctx, func() error {
+		_, err := q.client.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:     aws.String(q.url),
+			MessageBody:  aws.String(body),
+			DelaySeconds: int32(delay / time.Second),
+		})
+		return err
+	})
+}
+
+// SendBatch sends the message bodies to the queue in batches of up to 10,
+// the most SQS accepts per request
+func (q *SQS) SendBatch(ctx context.Context, bodies []string) []error {
+	errs := make([]error, len(bodies))
+	for start := 0; start < len(bodies); start += maxSQSBatch {
+		end := start + maxSQSBatch
+		if end > len(bodies) {
+			end = len(bodies)
+		}
+		entries := []types.SendMessageBatchRequestEntry{}
+		for i := start; i < end; i++ {
+			// the entry IDs only have to be unique within the batch:
+			entries = append(entries, types.SendMessageBatchRequestEntry{
+				Id:          aws.String(strconv.Itoa(i)),
+				MessageBody: aws.String(bodies[i]),
+			})
+		}
+		var resp *sqs.SendMessageBatchOutput
+		err := q.policy.Do(ctx, func() error {
+			var err error
+			resp, err = q.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+				QueueUrl: aws.String(q.url),
+				Entries:  entries,
+			})
+			return err
+		})
+		if err != nil {
+			for i := start; i < end; i++ {
+				errs[i] = err
+			}
+			continue
+		}
+		for _, failed := range resp.Failed {
+			i, err := strconv.Atoi(aws.ToString(failed.Id))
+			if err != nil || i < start || i >= end {
+				continue
+			}
+			errs[i] = fmt.Errorf("%v: %v", aws.ToString(failed.Code), aws.ToString(failed.Message))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"ecr.amazon.com/retry"
+)
+
+// stubSQS throttles the first throttles calls, then accepts every message
+type stubSQS struct {
+	throttles int
+	calls     int
+}
+
+func (stub *stubSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.calls++
+	w.Header().Set("Content-Type", "text/xml")
+	if stub.calls <= stub.throttles {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>RequestThrottled</Code><Message>Rate exceeded</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+		return
+	}
+	r.ParseForm()
+	switch r.Form.Get("Action") {
+	case "SendMessageBatch":
+		w.Write([]byte(`<SendMessageBatchResponse><SendMessageBatchResult>` +
+			`<SendMessageBatchResultEntry><Id>0</Id><MessageId>m0</MessageId></SendMessageBatchResultEntry>` +
+			`<SendMessageBatchResultEntry><Id>1</Id><MessageId>m1</MessageId></SendMessageBatchResultEntry>` +
+			`</SendMessageBatchResult></SendMessageBatchResponse>`))
+	default:
+		w.Write([]byte(`<SendMessageResponse><SendMessageResult><MessageId>m</MessageId></SendMessageResult></SendMessageResponse>`))
+	}
+}
+
+// newStubSQS returns an SQS queue calling the stub
+func newStubSQS(t *testing.T, stub *stubSQS) *SQS {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	client := sqs.New(sqs.Options{
+		Region:      "us-west-2",
+		Credentials: aws.AnonymousCredentials{},
+		EndpointResolver: sqs.EndpointResolverFunc(func(region string, options sqs.EndpointResolverOptions) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: server.URL}, nil
+		}),
+		Retryer: aws.NopRetryer{},
+	})
+	policy := retry.Policy{MaxAttempts: 3, Sleep: func(ctx context.Context, delay time.Duration) error { return nil }}
+	return &SQS{client: client, url: server.URL + "/queue", policy: policy}
+}
+
+func TestSQSRetriesThrottling(t *testing.T) {
+	ctx := context.Background()
+
+	stub := &stubSQS{throttles: 2}
+	if err := newStubSQS(t, stub).Send(ctx, "app", 0); err != nil || stub.calls != 3 {
+		t.Errorf("Send returned %v after %v calls, want success after 3 calls", err, stub.calls)
+	}
+
+	stub = &stubSQS{throttles: 3}
+	if err := newStubSQS(t, stub).Send(ctx, "app", 0); !retry.IsThrottle(err) || stub.calls != 3 {
+		t.Errorf("Send returned %v after %v calls, want throttling after 3 calls", err, stub.calls)
+	}
+
+	stub = &stubSQS{throttles: 1}
+	for i, err := range newStubSQS(t, stub).SendBatch(ctx, []string{"a", "b"}) {
+		if err != nil {
+			t.Errorf("sending message %v failed: %v", i, err)
+		}
+	}
+	if stub.calls != 2 {
+		t.Errorf("SendBatch took %v calls, want 2", stub.calls)
+	}
+
+	stub = &stubSQS{throttles: 3}
+	for i, err := range newStubSQS(t, stub).SendBatch(ctx, []string{"a", "b"}) {
+		if !retry.IsThrottle(err) {
+			t.Errorf("sending message %v returned %v, want throttling", i, err)
+		}
+	}
+}
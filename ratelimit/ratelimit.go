@@ -0,0 +1,193 @@
+// Package ratelimit throttles ECR calls on the client side with a token
+// bucket per region, so that a run doesn't use up the account-level API
+// limits that other users of the registry depend on.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRate is the number of calls per second allowed per region
+	// unless configured otherwise
+	DefaultRate = 5.0
+	// DefaultBurst is the number of calls that may be made at once after
+	// the limiter has been idle, unless configured otherwise
+	DefaultBurst = 5
+	// DefaultReadRate is the number of calls per second per region allowed
+	// to the API handlers reading scan findings unless configured otherwise
+	DefaultReadRate = 20.0
+	// DefaultReadBurst is the burst of the API handlers unless configured
+	// otherwise
+	DefaultReadBurst = 20
+)
+
+// now and sleep are replaceable for deterministic runs
+var (
+	now   = time.Now
+	sleep = func(ctx context.Context, delay time.Duration) error {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+)
+
+// bucket is a token bucket refilled at rate tokens per second up to burst
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token and returns how long to wait before it may be used
+func (b *bucket) reserve(t time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += t.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = t
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limiter hands out calls from one token bucket per region and keeps
+// track of how long callers had to wait for them. It is safe for
+// concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	rates   map[string]float64
+	buckets map[string]*bucket
+	waited  map[string]time.Duration
+}
+
+// New returns a limiter allowing rate calls per second with the given burst
+// in every region, except for the regions listed in rates
+func New(rate float64, burst int, rates map[string]float64) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		rates:   rates,
+		buckets: map[string]*bucket{},
+		waited:  map[string]time.Duration{},
+	}
+}
+
+// FromEnv returns a limiter configured by ECR_SCAN_RATE_LIMIT, the calls
+// per second per region, ECR_SCAN_RATE_BURST, and ECR_SCAN_REGION_RATE_LIMITS,
+// a comma separated list of region=rate overrides such as us-east-1=10.
+// These are the budget of the whole deployment: as every process has a
+// limiter of its own, the rates and the burst are divided by
+// ECR_SCAN_RATE_LIMIT_INSTANCES, the number of processes running at most at
+// the same time, with a burst of at least 1.
+func FromEnv() (*Limiter, error) {
+	return fromEnv("ECR_SCAN_RATE_LIMIT", "ECR_SCAN_RATE_BURST", "ECR_SCAN_REGION_RATE_LIMITS", "ECR_SCAN_RATE_LIMIT_INSTANCES", DefaultRate, DefaultBurst)
+}
+
+// ReadFromEnv returns the limiter of the API handlers reading scan
+// findings, configured by ECR_SCAN_READ_RATE_LIMIT, ECR_SCAN_READ_RATE_BURST
+// and ECR_SCAN_READ_REGION_RATE_LIMITS like FromEnv. It has a budget of its
+// own, so that requests aren't slowed down to the rate of the scans.
+func ReadFromEnv() (*Limiter, error) {
+	return fromEnv("ECR_SCAN_READ_RATE_LIMIT", "ECR_SCAN_READ_RATE_BURST", "ECR_SCAN_READ_REGION_RATE_LIMITS", "", DefaultReadRate, DefaultReadBurst)
+}
+
+// fromEnv returns a limiter configured by the given environment variables,
+// with the given defaults. Without instancesVar, the budget isn't divided.
+func fromEnv(rateVar, burstVar, regionsVar, instancesVar string, rate float64, burst int) (*Limiter, error) {
+	if raw := os.Getenv(rateVar); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid %v %q, must be a positive number", rateVar, raw)
+		}
+		rate = parsed
+	}
+	if raw := os.Getenv(burstVar); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			return nil, fmt.Errorf("invalid %v %q, must be a positive integer", burstVar, raw)
+		}
+		burst = parsed
+	}
+	rates := map[string]float64{}
+	if raw := os.Getenv(regionsVar); raw != "" {
+		for _, entry := range strings.Split(raw, ",") {
+			region, rawrate := "", ""
+			if parts := strings.SplitN(strings.TrimSpace(entry), "=", 2); len(parts) == 2 {
+				region, rawrate = parts[0], parts[1]
+			}
+			parsed, err := strconv.ParseFloat(rawrate, 64)
+			if region == "" || err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid %v entry %q, must be region=rate", regionsVar, entry)
+			}
+			rates[region] = parsed
+		}
+	}
+	instances := 1
+	if raw := os.Getenv(instancesVar); instancesVar != "" && raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			return nil, fmt.Errorf("invalid %v %q, must be a positive integer", instancesVar, raw)
+		}
+		instances = parsed
+	}
+	rate /= float64(instances)
+	for region := range rates {
+		rates[region] /= float64(instances)
+	}
+	burst /= instances
+	return New(rate, burst, rates), nil
+}
+
+// Wait blocks until a call may be made in the region or the context is done
+func (l *Limiter) Wait(ctx context.Context, region string) error {
+	l.mu.Lock()
+	b, ok := l.buckets[region]
+	if !ok {
+		rate, ok := l.rates[region]
+		if !ok {
+			rate = l.rate
+		}
+		b = &bucket{rate: rate, burst: float64(l.burst), tokens: float64(l.burst)}
+		l.buckets[region] = b
+	}
+	delay := b.reserve(now())
+	l.waited[region] += delay
+	l.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	return sleep(ctx, delay)
+}
+
+// Waited returns the total time callers waited for the limiter, per region
+func (l *Limiter) Waited() map[string]time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	waited := make(map[string]time.Duration, len(l.waited))
+	for region, d := range l.waited {
+		waited[region] = d
+	}
+	return waited
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"os"
+	"testing"
+)
+
+// setenv sets the environment variables and returns a function restoring them
+func setenv(env map[string]string) func() {
+	saved := map[string]string{}
+	for name, value := range env {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = old
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range env {
+			if old, ok := saved[name]; ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+func TestFromEnvSharesBudget(t *testing.T) {
+	tests := []struct {
+		instances string
+		rate      float64
+		burst     int
+		regional  float64
+	}{
+		{"", 8, 6, 2},
+		{"1", 8, 6, 2},
+		{"4", 2, 1, 0.5},
+		{"16", 0.5, 1, 0.125},
+	}
+	for _, test := range tests {
+		restore := setenv(map[string]string{
+			"ECR_SCAN_RATE_LIMIT":           "8",
+			"ECR_SCAN_RATE_BURST":           "6",
+			"ECR_SCAN_REGION_RATE_LIMITS":   "eu-west-1=2",
+			"ECR_SCAN_RATE_LIMIT_INSTANCES": test.instances,
+		})
+		l, err := FromEnv()
+		restore()
+		if err != nil {
+			t.Errorf("%q instances: %v", test.instances, err)
+			continue
+		}
+		if l.rate != test.rate || l.burst != test.burst || l.rates["eu-west-1"] != test.regional {
+			t.Errorf("%q instances: rate %v, burst %v, eu-west-1 %v, want %v, %v, %v",
+				test.instances, l.rate, l.burst, l.rates["eu-west-1"], test.rate, test.burst, test.regional)
+		}
+	}
+	for _, invalid := range []string{"0", "-2", "four"} {
+		restore := setenv(map[string]string{"ECR_SCAN_RATE_LIMIT_INSTANCES": invalid})
+		_, err := FromEnv()
+		restore()
+		if err == nil {
+			t.Errorf("FromEnv with %q instances didn't fail", invalid)
+		}
+	}
+}
+
+func TestReadFromEnvHasOwnBudget(t *testing.T) {
+	restore := setenv(map[string]string{
+		"ECR_SCAN_RATE_LIMIT":              "1",
+		"ECR_SCAN_RATE_BURST":              "1",
+		"ECR_SCAN_RATE_LIMIT_INSTANCES":    "4",
+		"ECR_SCAN_READ_RATE_LIMIT":         "",
+		"ECR_SCAN_READ_RATE_BURST":         "",
+		"ECR_SCAN_READ_REGION_RATE_LIMITS": "",
+	})
+	defer restore()
+	l, err := ReadFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.rate != DefaultReadRate || l.burst != DefaultReadBurst {
+		t.Errorf("rate %v, burst %v, want the read defaults %v, %v", l.rate, l.burst, DefaultReadRate, DefaultReadBurst)
+	}
+
+	os.Setenv("ECR_SCAN_READ_RATE_LIMIT", "12")
+	os.Setenv("ECR_SCAN_READ_RATE_BURST", "3")
+	os.Setenv("ECR_SCAN_READ_REGION_RATE_LIMITS", "eu-west-1=6")
+	l, err = ReadFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.rate != 12 || l.burst != 3 || l.rates["eu-west-1"] != 6 {
+		t.Errorf("rate %v, burst %v, eu-west-1 %v, want 12, 3, 6", l.rate, l.burst, l.rates["eu-west-1"])
+	}
+
+	os.Setenv("ECR_SCAN_READ_RATE_LIMIT", "fast")
+	if _, err := ReadFromEnv(); err == nil {
+		t.Error("ReadFromEnv with an invalid rate didn't fail")
+	}
+}
@@ -0,0 +1,150 @@
+// Package retry retries ECR, S3, DynamoDB and SQS calls that failed with a
+// throttling or other transient error, backing off exponentially with jitter
+// in between.
+// The SDK clients are configured not to retry themselves, so that the
+// policy here is the only budget applied to a call.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	v2retry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// Policy describes how often and how long a failing call is retried
+type Policy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int
+	// BaseDelay is the upper bound of the delay before the first retry,
+	// doubling with every further retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay before any retry
+	MaxDelay time.Duration
+	// Retryable decides whether an error is worth retrying, IsRetryable if nil
+	Retryable func(error) bool
+	// Sleep waits for the given delay or until the context is done,
+	// replaceable for deterministic runs
+	Sleep func(ctx context.Context, delay time.Duration) error
+}
+
+// Default is the policy used unless overridden from the environment
+var Default = Policy{
+	MaxAttempts: 5,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// FromEnv returns the default policy with the number of attempts and the
+// delays overridden by ECR_SCAN_RETRY_MAX_ATTEMPTS,
+// ECR_SCAN_RETRY_BASE_DELAY and ECR_SCAN_RETRY_MAX_DELAY, where set
+func FromEnv() Policy {
+	p := Default
+	if attempts, err := strconv.Atoi(os.Getenv("ECR_SCAN_RETRY_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		p.MaxAttempts = attempts
+	}
+	if delay, err := time.ParseDuration(os.Getenv("ECR_SCAN_RETRY_BASE_DELAY")); err == nil && delay > 0 {
+		p.BaseDelay = delay
+	}
+	if delay, err := time.ParseDuration(os.Getenv("ECR_SCAN_RETRY_MAX_DELAY")); err == nil && delay > 0 {
+		p.MaxDelay = delay
+	}
+	return p
+}
+
+// Do calls fn until it succeeds, fails with an error that isn't retryable,
+// the attempts are used up or the context is done, and returns the error of
+// the last attempt
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	sleep := p.Sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+		if serr := sleep(ctx, p.Delay(attempt)); serr != nil {
+			return err
+		}
+	}
+}
+
+// Delay returns the delay before the retry following the given attempt,
+// drawn uniformly up to the exponential bound ("full jitter") so that
+// concurrent callers spread out instead of retrying in lockstep
+func (p Policy) Delay(attempt int) time.Duration {
+	bound := p.BaseDelay
+	for i := 1; i < attempt && bound < p.MaxDelay; i++ {
+		bound *= 2
+	}
+	if bound > p.MaxDelay {
+		bound = p.MaxDelay
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1))
+}
+
+// IsRetryable reports whether err is a throttling or transient error of an
+// AWS call. ECR's LimitExceededException isn't, as it signals the
+// daily scan quota of an image rather than a request rate.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if IsLimitExceeded(err) {
+		return false
+	}
+	return v2retry.IsErrorRetryables(v2retry.DefaultRetryables).IsErrorRetryable(err).Bool()
+}
+
+// throttleCodes are the error codes AWS services report throttling with
+var throttleCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"RequestLimitExceeded":                   true,
+	"BandwidthLimitExceeded":                 true,
+	"RequestThrottled":                       true,
+	"SlowDown":                               true,
+}
+
+// IsThrottle reports whether the call failed because it was throttled
+func IsThrottle(err error) bool {
+	var aerr smithy.APIError
+	return errors.As(err, &aerr) && throttleCodes[aerr.ErrorCode()]
+}
+
+// IsLimitExceeded reports whether ECR refused the call with a
+// LimitExceededException, which for image scans means the image was
+// scanned within the last 24 hours already and retrying won't help
+func IsLimitExceeded(err error) bool {
+	var aerr smithy.APIError
+	return errors.As(err, &aerr) && aerr.ErrorCode() == "LimitExceededException"
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
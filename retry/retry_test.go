@@ -0,0 +1,159 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/smithy-go"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/retry"
+)
+
+// fakeECR fails StartImageScan with err for the first failures calls
+type fakeECR struct {
+	ecrclient.API
+	err      error
+	failures int
+	calls    int
+}
+
+func (f *fakeECR) StartImageScan(ctx context.Context, params *ecr.StartImageScanInput, optFns ...func(*ecr.Options)) (*ecr.StartImageScanOutput, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, f.err
+	}
+	return &ecr.StartImageScanOutput{}, nil
+}
+
+var (
+	throttled     = &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	limitExceeded = &smithy.GenericAPIError{Code: "LimitExceededException", Message: "image scan limit exceeded"}
+)
+
+// testPolicy returns a policy that records its delays instead of sleeping
+func testPolicy(maxAttempts int, delays *[]time.Duration) retry.Policy {
+	return retry.Policy{
+		MaxAttempts: maxAttempts,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Sleep: func(ctx context.Context, delay time.Duration) error {
+			*delays = append(*delays, delay)
+			return nil
+		},
+	}
+}
+
+func startScan(ctx context.Context, p retry.Policy, svc ecrclient.API) error {
+	return p.Do(ctx, func() error {
+		_, err := svc.StartImageScan(ctx, &ecr.StartImageScanInput{})
+		return err
+	})
+}
+
+func TestDo(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		failures    int
+		maxAttempts int
+		calls       int
+		fails       bool
+	}{
+		{"succeeds at once", throttled, 0, 5, 1, false},
+		{"retries throttling", throttled, 3, 5, 4, false},
+		{"succeeds on the last attempt", throttled, 4, 5, 5, false},
+		{"stops at max attempts", throttled, 10, 5, 5, true},
+		{"single attempt", throttled, 10, 1, 1, true},
+		{"doesn't retry limit exceeded", limitExceeded, 10, 5, 1, true},
+		{"doesn't retry other errors", errors.New("boom"), 10, 5, 1, true},
+	}
+	for _, test := range tests {
+		svc := &fakeECR{err: test.err, failures: test.failures}
+		delays := []time.Duration{}
+		err := startScan(context.Background(), testPolicy(test.maxAttempts, &delays), svc)
+		if svc.calls != test.calls {
+			t.Errorf("%v: called %v times, want %v", test.name, svc.calls, test.calls)
+		}
+		if len(delays) != test.calls-1 {
+			t.Errorf("%v: slept %v times, want %v", test.name, len(delays), test.calls-1)
+		}
+		if (err != nil) != test.fails {
+			t.Errorf("%v: returned %v, want failure %v", test.name, err, test.fails)
+		}
+		if test.fails && !errors.Is(err, test.err) {
+			t.Errorf("%v: returned %v, want the error of the last attempt %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestDoStopsWhenSleepFails(t *testing.T) {
+	svc := &fakeECR{err: throttled, failures: 10}
+	p := retry.Policy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Second,
+		Sleep: func(ctx context.Context, delay time.Duration) error {
+			return context.DeadlineExceeded
+		},
+	}
+	err := startScan(context.Background(), p, svc)
+	if svc.calls != 1 || !errors.Is(err, throttled) {
+		t.Errorf("called %v times returning %v, want 1 call returning %v", svc.calls, err, throttled)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := retry.Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	bounds := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+		time.Second,
+	}
+	for i, bound := range bounds {
+		attempt := i + 1
+		for n := 0; n < 200; n++ {
+			if delay := p.Delay(attempt); delay < 0 || delay > bound {
+				t.Fatalf("Delay(%v) = %v, want between 0 and %v", attempt, delay, bound)
+			}
+		}
+	}
+	if delay := (retry.Policy{}).Delay(3); delay != 0 {
+		t.Errorf("Delay without delays = %v, want 0", delay)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		throttle  bool
+	}{
+		{"nil", nil, false, false},
+		{"throttling", throttled, true, true},
+		{"wrapped throttling", &smithy.OperationError{ServiceID: "ECR", OperationName: "StartImageScan", Err: throttled}, true, true},
+		{"limit exceeded", limitExceeded, false, false},
+		{"canceled", context.Canceled, false, false},
+		{"deadline", context.DeadlineExceeded, false, false},
+		{"not found", &smithy.GenericAPIError{Code: "ImageNotFoundException"}, false, false},
+	}
+	for _, test := range tests {
+		if got := retry.IsRetryable(test.err); got != test.retryable {
+			t.Errorf("%v: IsRetryable = %v, want %v", test.name, got, test.retryable)
+		}
+		if got := retry.IsThrottle(test.err); got != test.throttle {
+			t.Errorf("%v: IsThrottle = %v, want %v", test.name, got, test.throttle)
+		}
+	}
+	if !retry.IsLimitExceeded(limitExceeded) || retry.IsLimitExceeded(throttled) {
+		t.Error("IsLimitExceeded doesn't tell limit exceeded from throttling")
+	}
+}
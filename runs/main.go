@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"ecr.amazon.com/history"
+)
+
+const (
+	// defaultPageSize is the number of runs listed unless limit is given
+	defaultPageSize = 20
+	// maxPageSize caps the limit query parameter of a listing
+	maxPageSize = 100
+)
+
+// runsPage is the response to a listing of scan runs
+type runsPage struct {
+	Runs []history.Summary `json:"runs"`
+	// Next is the cursor to pass to fetch the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+func serverError(err error) (events.APIGatewayProxyResponse, error) {
+	fmt.Println(err.Error())
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusInternalServerError,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		Body: fmt.Sprintf("%v", err.Error()),
+	}, nil
+}
+
+func badRequest(msg string) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusBadRequest,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		Body: msg,
+	}, nil
+}
+
+func jsonResponse(v interface{}) (events.APIGatewayProxyResponse, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return serverError(err)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type":                "application/json",
+			"Access-Control-Allow-Origin": "*",
+		},
+		Body: string(body),
+	}, nil
+}
+
+var runs history.RunStore
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	fmt.Printf("DEBUG:: runs start\n")
+	if runID, ok := request.PathParameters["id"]; ok {
+		fmt.Printf("DEBUG:: fetching scan run %v\n", runID)
+		run, err := history.Load(ctx, runs, runID)
+		if err != nil {
+			if errors.Is(err, history.ErrNotFound) {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusNotFound,
+					Headers: map[string]string{
+						"Content-Type":                "application/json",
+						"Access-Control-Allow-Origin": "*",
+					},
+					Body: "This scan run does not exist",
+				}, nil
+			}
+			return serverError(err)
+		}
+		return jsonResponse(run)
+	}
+	fmt.Printf("DEBUG:: listing scan runs\n")
+	limit := defaultPageSize
+	var err error
+	if rawlimit, ok := request.QueryStringParameters["limit"]; ok {
+		limit, err = strconv.Atoi(rawlimit)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return badRequest(fmt.Sprintf("limit must be a number between 1 and %v", maxPageSize))
+		}
+	}
+	runIDs, next, err := runs.Page(ctx, limit, request.QueryStringParameters["next"])
+	if err != nil {
+		if errors.Is(err, history.ErrInvalidCursor) {
+			return badRequest("invalid cursor")
+		}
+		return serverError(err)
+	}
+	page := runsPage{Runs: []history.Summary{}, Next: next}
+	for _, runID := range runIDs {
+		// the run record summarizes its parts, which aren't loaded here:
+		run, err := runs.Fetch(ctx, runID)
+		if err != nil {
+			return serverError(fmt.Errorf("can't load scan run %v: %w", runID, err))
+		}
+		page.Runs = append(page.Runs, run.Summary())
+	}
+	fmt.Printf("DEBUG:: runs done\n")
+	return jsonResponse(page)
+}
+
+func main() {
+	var err error
+	runs, err = history.NewFromEnv(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	lambda.Start(handler)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+
+	"ecr.amazon.com/scan"
+)
+
+// worker is created once per Lambda instance, so that its rate limiter
+// carries over between invocations
+var worker *scan.Worker
+
+// handler processes the scan messages delivered by SQS. Returning an error
+// makes SQS deliver the batch again, until its redrive policy moves the
+// messages to the dead-letter queue.
+func handler(ctx context.Context, event events.SQSEvent) error {
+	fmt.Printf("DEBUG:: worker start\n")
+	for _, record := range event.Records {
+		err := worker.Handle(ctx, record.Body)
+		if err != nil {
+			fmt.Printf("Can't process message %v: %v\n", record.MessageId, err)
+			return err
+		}
+	}
+	fmt.Printf("DEBUG:: worker done\n")
+	return nil
+}
+
+func main() {
+	var err error
+	worker, err = scan.NewWorkerFromEnv(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	lambda.Start(handler)
+}
@@ -0,0 +1,146 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"ecr.amazon.com/history"
+	"ecr.amazon.com/queue"
+	"ecr.amazon.com/spec"
+	"ecr.amazon.com/target"
+)
+
+// ImagePush is an image pushed to ECR, as reported by an ECR Image Action event
+type ImagePush struct {
+	Region     string `json:"region"`
+	RegistryID string `json:"registry"`
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+// imageAction is the detail of an EventBridge ECR Image Action event
+type imageAction struct {
+	ActionType     string `json:"action-type"`
+	Result         string `json:"result"`
+	RepositoryName string `json:"repository-name"`
+	ImageDigest    string `json:"image-digest"`
+	ImageTag       string `json:"image-tag"`
+}
+
+// PushFromEvent returns the image pushed according to the event, and false
+// if the event isn't about a successful push
+func PushFromEvent(event events.CloudWatchEvent) (ImagePush, bool, error) {
+	if event.Source != "aws.ecr" || event.DetailType != "ECR Image Action" {
+		return ImagePush{}, false, nil
+	}
+	action := imageAction{}
+	if err := json.Unmarshal(event.Detail, &action); err != nil {
+		return ImagePush{}, false, fmt.Errorf("invalid ECR image action: %w", err)
+	}
+	if action.ActionType != "PUSH" || action.Result != "SUCCESS" {
+		return ImagePush{}, false, nil
+	}
+	return ImagePush{
+		Region:     event.Region,
+		RegistryID: event.AccountID,
+		Repository: action.RepositoryName,
+		Digest:     action.ImageDigest,
+		Tag:        action.ImageTag,
+	}, true, nil
+}
+
+// Matches reports whether the scan spec selects the pushed image, by its tag
+// or its digest, in its repository or one it discovers
+func (push ImagePush) Matches(scanspec spec.ScanSpec) (bool, error) {
+	if scanspec.Region != push.Region || scanspec.RegistryID != push.RegistryID {
+		return false, nil
+	}
+	matches, err := scanspec.MatchesRepository(push.Repository)
+	if err != nil || !matches {
+		return false, err
+	}
+	for _, digest := range scanspec.Digests {
+		if digest == push.Digest {
+			return true, nil
+		}
+	}
+	if push.Tag == "" {
+		return false, nil
+	}
+	sel, err := spec.NewTagSelector(scanspec)
+	if err != nil {
+		return false, err
+	}
+	return sel.Matches(push.Tag), nil
+}
+
+// image returns the pushed image as the scan spec selects it
+func (push ImagePush) image(scanspec spec.ScanSpec) target.Image {
+	img := target.Image{Tags: []string{}, Digest: push.Digest}
+	if push.Tag == "" {
+		return img
+	}
+	if sel, err := spec.NewTagSelector(scanspec); err == nil && sel.Matches(push.Tag) {
+		img.Tags = []string{push.Tag}
+	}
+	return img
+}
+
+// DispatchPush records a new run of the active scan specs matching the
+// pushed image and enqueues a message per matching scan spec, asking the
+// workers to scan just that image. Schedules don't apply and the last run of
+// the scan specs is left alone. Scan specs that can't be loaded, and so
+// might match, are recorded as failed or not found results of the run. If no
+// scan spec matches and all could be loaded, no run is recorded and the
+// returned run has no scan specs.
+func DispatchPush(ctx context.Context, specs spec.SpecStore, runs history.RunStore, q queue.Queue, push ImagePush, now time.Time) (history.Run, error) {
+	run := history.NewRun(now)
+	loadedSpecs, err := spec.ListAll(ctx, specs)
+	if err != nil {
+		return run, err
+	}
+	for _, loaded := range loadedSpecs {
+		if loaded.Err != nil {
+			fmt.Printf("Can't load scan spec %v: %v\n", loaded.ID, loaded.Err)
+			run.Results = append(run.Results, loadFailure(loaded))
+			continue
+		}
+		matches, err := push.Matches(loaded.Spec)
+		if err != nil {
+			fmt.Printf("Can't match scan spec %v: %v\n", loaded.ID, err)
+			continue
+		}
+		if !matches {
+			continue
+		}
+		if !loaded.Spec.Active(now) {
+			fmt.Printf("DEBUG:: skipping disabled or snoozed scan spec %v\n", loaded.ID)
+			continue
+		}
+		run.Specs = append(run.Specs, loaded.ID)
+	}
+	if len(run.Specs) == 0 && len(run.Results) == 0 {
+		return run, nil
+	}
+	err = runs.Store(ctx, run)
+	if err != nil {
+		return run, fmt.Errorf("can't record scan run %v: %w", run.ID, err)
+	}
+	failed := 0
+	for _, scanID := range run.Specs {
+		err := Message{RunID: run.ID, SpecID: scanID, Push: &push}.send(ctx, q, 0)
+		if err != nil {
+			fmt.Printf("Can't enqueue scan spec %v of run %v: %v\n", scanID, run.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return run, fmt.Errorf("can't enqueue %v of %v scan specs of run %v", failed, len(run.Specs), run.ID)
+	}
+	return run, nil
+}
@@ -0,0 +1,146 @@
+package scan
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"ecr.amazon.com/spec"
+)
+
+const pushedDigest = "sha256:7f5b2640fe6fb4f46592dfd3410c4a79dac4f89e4782432e0378abcd1234abcd"
+
+// recordedEvent returns the recorded push event of push-scan, with its
+// detail changed by edit
+func recordedEvent(t *testing.T, edit func(detail map[string]string)) events.CloudWatchEvent {
+	raw, err := ioutil.ReadFile("../push-scan/event.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := events.CloudWatchEvent{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		t.Fatal(err)
+	}
+	if edit != nil {
+		detail := map[string]string{}
+		if err := json.Unmarshal(event.Detail, &detail); err != nil {
+			t.Fatal(err)
+		}
+		edit(detail)
+		if event.Detail, err = json.Marshal(detail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return event
+}
+
+func TestPushFromEvent(t *testing.T) {
+	push, ok, err := PushFromEvent(recordedEvent(t, nil))
+	if err != nil || !ok {
+		t.Fatalf("PushFromEvent = %v, %v, want the push", ok, err)
+	}
+	want := ImagePush{
+		Region:     "us-west-2",
+		RegistryID: "148658015984",
+		Repository: "amazonlinux",
+		Digest:     pushedDigest,
+		Tag:        "2018.03",
+	}
+	if push != want {
+		t.Errorf("PushFromEvent = %+v, want %+v", push, want)
+	}
+
+	untagged, ok, err := PushFromEvent(recordedEvent(t, func(detail map[string]string) {
+		delete(detail, "image-tag")
+	}))
+	if err != nil || !ok || untagged.Tag != "" || untagged.Digest != pushedDigest {
+		t.Errorf("PushFromEvent of an untagged push = %+v, %v, %v", untagged, ok, err)
+	}
+
+	ignored := map[string]func(detail map[string]string){
+		"delete": func(detail map[string]string) { detail["action-type"] = "DELETE" },
+		"failed": func(detail map[string]string) { detail["result"] = "FAILED" },
+	}
+	for name, edit := range ignored {
+		push, ok, err := PushFromEvent(recordedEvent(t, edit))
+		if err != nil || ok {
+			t.Errorf("%v: PushFromEvent = %+v, %v, %v, want it ignored", name, push, ok, err)
+		}
+	}
+
+	other := recordedEvent(t, nil)
+	other.DetailType = "ECR Image Scan"
+	if _, ok, err := PushFromEvent(other); err != nil || ok {
+		t.Errorf("PushFromEvent of a scan event = %v, %v, want it ignored", ok, err)
+	}
+
+	broken := recordedEvent(t, nil)
+	broken.Detail = json.RawMessage(`"PUSH"`)
+	if _, ok, err := PushFromEvent(broken); err == nil || ok {
+		t.Errorf("PushFromEvent of a broken event = %v, %v, want an error", ok, err)
+	}
+}
+
+func TestPushMatches(t *testing.T) {
+	push, _, err := PushFromEvent(recordedEvent(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := spec.ScanSpec{Region: "us-west-2", RegistryID: "148658015984"}
+	with := func(edit func(ss *spec.ScanSpec)) spec.ScanSpec {
+		scanspec := base
+		edit(&scanspec)
+		return scanspec
+	}
+	tests := []struct {
+		name     string
+		scanspec spec.ScanSpec
+		matches  bool
+	}{
+		{"single repository, all tags", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux" }), true},
+		{"other repository", with(func(ss *spec.ScanSpec) { ss.Repository = "ubuntu" }), false},
+		{"other region", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.Region = "eu-west-1" }), false},
+		{"other registry", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.RegistryID = "123456789012" }), false},
+		{"tag", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.Tags = []string{"2018.03"} }), true},
+		{"other tag", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.Tags = []string{"2"} }), false},
+		{"tag pattern", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.TagPatterns = []string{"2018.*"} }), true},
+		{"regular expression", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.TagPatterns = []string{`re:\d{4}\.\d{2}`} }), true},
+		{"excluded tag", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.ExcludeTags = []string{"2018.*"} }), false},
+		{"digest", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.Digests = []string{pushedDigest} }), true},
+		{"other digest", with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.Digests = []string{"sha256:0000"} }), false},
+		{"discovery of all repositories", base, true},
+		{"discovery by glob", with(func(ss *spec.ScanSpec) { ss.Repository = "amazon*" }), true},
+		{"discovery by prefix", with(func(ss *spec.ScanSpec) { ss.Repository = "team/" }), false},
+		{"discovery excluding the repository", with(func(ss *spec.ScanSpec) { ss.ExcludeRepositories = []string{"amazon*"} }), false},
+		{"discovery including the repository", with(func(ss *spec.ScanSpec) { ss.IncludeRepositories = []string{"amazonlinux", "ubuntu"} }), true},
+		{"discovery by digest", with(func(ss *spec.ScanSpec) { ss.Repository = "amazon*"; ss.Digests = []string{pushedDigest} }), true},
+	}
+	for _, test := range tests {
+		matches, err := push.Matches(test.scanspec)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if matches != test.matches {
+			t.Errorf("%v: Matches = %v, want %v", test.name, matches, test.matches)
+		}
+	}
+
+	untagged := push
+	untagged.Tag = ""
+	onlyDigest := with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.Digests = []string{pushedDigest} })
+	if matches, err := untagged.Matches(onlyDigest); err != nil || !matches {
+		t.Errorf("untagged push by digest: Matches = %v, %v, want true", matches, err)
+	}
+	allTags := with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux" })
+	if matches, err := untagged.Matches(allTags); err != nil || matches {
+		t.Errorf("untagged push by tag: Matches = %v, %v, want false", matches, err)
+	}
+
+	invalid := with(func(ss *spec.ScanSpec) { ss.Repository = "amazonlinux"; ss.TagPatterns = []string{"re:(("} })
+	if _, err := push.Matches(invalid); err == nil {
+		t.Error("Matches with an invalid tag pattern didn't fail")
+	}
+}
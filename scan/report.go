@@ -0,0 +1,133 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/history"
+	"ecr.amazon.com/ratelimit"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+// defaultMaxFailureRatio is the share of failed targets above which the
+// scan of a scan spec fails, unless overridden by ECR_SCAN_MAX_FAILURE_RATIO
+const defaultMaxFailureRatio = 0.5
+
+// Report collects the results of all targets of a scan spec in its part of
+// the run record
+type Report struct {
+	history.Part
+	limiter *ratelimit.Limiter
+	// waited is the limiter wait before the report was started, as the
+	// limiter is shared with earlier messages
+	waited map[string]time.Duration
+}
+
+// newReport returns a report for the given part, taking the time waited for
+// the limiter from now on into account
+func newReport(part history.Part, limiter *ratelimit.Limiter) *Report {
+	return &Report{Part: part, limiter: limiter, waited: limiter.Waited()}
+}
+
+// add records the outcome of a target, classifying err if not nil
+func (r *Report) add(result history.TargetResult, err error) {
+	result.Status = history.StatusStarted
+	if err != nil {
+		result.Status = classify(err)
+		result.Error = err.Error()
+		fmt.Printf("DEBUG:: %v %v %v: %v\n", result.Status, result.Repository, result.Image, err)
+	}
+	r.Results = append(r.Results, result)
+}
+
+// skipFresh records a target that wasn't scanned as its last scan completed
+// within the freshness window
+func (r *Report) skipFresh(result history.TargetResult, completed time.Time) {
+	result.Status = history.StatusSkippedRecentlyScanned
+	result.ScanStatusDescription = fmt.Sprintf("last scan completed at %v", completed.UTC().Format(time.RFC3339))
+	fmt.Printf("DEBUG:: %v %v %v: %v\n", result.Status, result.Repository, result.Image, result.ScanStatusDescription)
+	r.Results = append(r.Results, result)
+}
+
+// finish sets the end time of the part and adds the time waited for the
+// limiter since the report was started
+func (r *Report) finish(end time.Time) {
+	r.EndTime = fmt.Sprintf("%v", end.Unix())
+	if r.LimiterWait == nil {
+		r.LimiterWait = map[string]int64{}
+	}
+	for region, d := range r.limiter.Waited() {
+		if waited := (d - r.waited[region]).Milliseconds(); waited > 0 {
+			r.LimiterWait[region] += waited
+		}
+	}
+}
+
+// log prints a summary of the part
+func (r *Report) log() {
+	counts := r.Counts()
+	waited := int64(0)
+	for _, ms := range r.LimiterWait {
+		waited += ms
+	}
+	fmt.Printf("Scan run %v, scan spec %v: %v targets, %v started, %v skipped-recently-scanned, %v not-found, %v throttled, %v failed, %vms rate limiter wait\n",
+		r.RunID, r.SpecID, len(r.Results), counts[history.StatusStarted], counts[history.StatusSkippedRecentlyScanned],
+		counts[history.StatusNotFound], counts[history.StatusThrottled], counts[history.StatusFailed], waited)
+}
+
+// failureRatio returns the share of targets of the part that failed or
+// were throttled
+func failureRatio(part history.Part) float64 {
+	if len(part.Results) == 0 {
+		return 0
+	}
+	counts := part.Counts()
+	return float64(counts[history.StatusFailed]+counts[history.StatusThrottled]) / float64(len(part.Results))
+}
+
+// classify maps the error of a target to its status
+func classify(err error) history.Status {
+	if errors.Is(err, spec.ErrNotFound) {
+		return history.StatusNotFound
+	}
+	if retry.IsThrottle(err) {
+		return history.StatusThrottled
+	}
+	if retry.IsLimitExceeded(err) {
+		// ECR allows one basic scan per image every 24 hours:
+		return history.StatusSkippedRecentlyScanned
+	}
+	var repoNotFound *types.RepositoryNotFoundException
+	var imageNotFound *types.ImageNotFoundException
+	if errors.As(err, &repoNotFound) || errors.As(err, &imageNotFound) {
+		return history.StatusNotFound
+	}
+	return history.StatusFailed
+}
+
+// freshnessWindowFromEnv returns the window set in ECR_SCAN_FRESHNESS_WINDOW,
+// within which a completed scan makes another one unnecessary, or zero if
+// the pre-check is disabled
+func freshnessWindowFromEnv() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("ECR_SCAN_FRESHNESS_WINDOW"))
+	if err != nil || window < 0 {
+		return 0
+	}
+	return window
+}
+
+// maxFailureRatioFromEnv returns the share of failed targets tolerated in
+// the scan of a scan spec, as configured in ECR_SCAN_MAX_FAILURE_RATIO
+func maxFailureRatioFromEnv() float64 {
+	ratio, err := strconv.ParseFloat(os.Getenv("ECR_SCAN_MAX_FAILURE_RATIO"), 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return defaultMaxFailureRatio
+	}
+	return ratio
+}
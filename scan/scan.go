@@ -0,0 +1,447 @@
+// Package scan fans a scan run out over a queue: the dispatcher enqueues one
+// message per scan spec, and workers start the image scans of a scan spec
+// and record them as their part of the run.
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/history"
+	"ecr.amazon.com/queue"
+	"ecr.amazon.com/ratelimit"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+	"ecr.amazon.com/target"
+)
+
+// newECR returns the ECR client for the region and role, replaceable for
+// tests
+var newECR = ecrclient.New
+
+// Message asks a worker to scan the images of a scan spec as part of a run,
+// or, if Pending is set, to keep waiting for the scans it started
+type Message struct {
+	RunID  string `json:"run"`
+	SpecID string `json:"spec"`
+	// Push limits the scan to the pushed image instead of all images the
+	// scan spec selects
+	Push *ImagePush `json:"push,omitempty"`
+	// Pending lists the started scans a follow-up waits for
+	Pending []pendingScan `json:"pending,omitempty"`
+	// FollowUps numbers the follow-ups of the scan spec, starting at 1
+	FollowUps int `json:"followUps,omitempty"`
+}
+
+// send encodes the message and enqueues it with the given delay
+func (msg Message) send(ctx context.Context, q queue.Queue, delay time.Duration) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return q.Send(ctx, string(body), delay)
+}
+
+// Dispatch records a new run of the scan specs due at the given time and
+// enqueues a message per due scan spec for the workers, in batches, marking
+// each enqueued scan spec as run for the schedule slot it was due for, in
+// parallel. Disabled and snoozed scan specs are never due. Scan specs that
+// can't be loaded are recorded as failed or not found results of the run.
+// If no scan spec is due and all could be loaded, no run is recorded and
+// the returned run has no scan specs.
+func Dispatch(ctx context.Context, specs spec.SpecStore, runs history.RunStore, q queue.Queue, now time.Time) (history.Run, error) {
+	run := history.NewRun(now)
+	defaultSchedule, err := defaultScheduleFromEnv()
+	if err != nil {
+		return run, err
+	}
+	loadedSpecs, err := spec.ListAll(ctx, specs)
+	if err != nil {
+		return run, err
+	}
+	slots := map[string]time.Time{}
+	for _, loaded := range loadedSpecs {
+		if loaded.Err != nil {
+			fmt.Printf("Can't load scan spec %v: %v\n", loaded.ID, loaded.Err)
+			run.Results = append(run.Results, loadFailure(loaded))
+			continue
+		}
+		if !loaded.Spec.Active(now) {
+			fmt.Printf("DEBUG:: skipping disabled or snoozed scan spec %v\n", loaded.ID)
+			continue
+		}
+		slot, due, err := loaded.Spec.Due(now, defaultSchedule)
+		if err != nil {
+			fmt.Printf("Can't schedule scan spec %v: %v\n", loaded.ID, err)
+			continue
+		}
+		if due {
+			run.Specs = append(run.Specs, loaded.ID)
+			slots[loaded.ID] = slot
+		}
+	}
+	if len(run.Specs) == 0 && len(run.Results) == 0 {
+		return run, nil
+	}
+	// the run has to exist before any worker stores its part:
+	err = runs.Store(ctx, run)
+	if err != nil {
+		return run, fmt.Errorf("can't record scan run %v: %w", run.ID, err)
+	}
+	bodies := []string{}
+	for _, scanID := range run.Specs {
+		body, err := json.Marshal(Message{RunID: run.ID, SpecID: scanID})
+		if err != nil {
+			return run, err
+		}
+		bodies = append(bodies, string(body))
+	}
+	sent := []string{}
+	for i, err := range q.SendBatch(ctx, bodies) {
+		if err != nil {
+			fmt.Printf("Can't enqueue scan spec %v of run %v: %v\n", run.Specs[i], run.ID, err)
+			continue
+		}
+		sent = append(sent, run.Specs[i])
+	}
+	markRuns(ctx, specs, sent, slots)
+	if failed := len(run.Specs) - len(sent); failed > 0 {
+		return run, fmt.Errorf("can't enqueue %v of %v scan specs of run %v", failed, len(run.Specs), run.ID)
+	}
+	return run, nil
+}
+
+// markRuns records the schedule slot each of the enqueued scan specs was
+// dispatched for, with as many updates in flight as scan specs are fetched
+// in parallel
+func markRuns(ctx context.Context, specs spec.SpecStore, scanIDs []string, slots map[string]time.Time) {
+	concurrency := spec.ConcurrencyFromEnv()
+	if concurrency > len(scanIDs) {
+		concurrency = len(scanIDs)
+	}
+	next := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for scanID := range next {
+				err := specs.MarkRun(ctx, scanID, fmt.Sprintf("%v", slots[scanID].Unix()))
+				if err != nil {
+					fmt.Printf("Can't record last run of scan spec %v: %v\n", scanID, err)
+				}
+			}
+		}()
+	}
+	for _, scanID := range scanIDs {
+		next <- scanID
+	}
+	close(next)
+	wg.Wait()
+}
+
+// loadFailure returns the result of a scan spec that couldn't be loaded
+func loadFailure(loaded spec.Result) history.TargetResult {
+	err := fmt.Errorf("can't load scan spec %v: %w", loaded.ID, loaded.Err)
+	return history.TargetResult{SpecID: loaded.ID, Status: classify(err), Error: err.Error()}
+}
+
+// defaultScheduleFromEnv returns the schedule of scan specs without one, as
+// set in ECR_SCAN_DEFAULT_SCHEDULE, or spec.DefaultSchedule
+func defaultScheduleFromEnv() (string, error) {
+	expr := os.Getenv("ECR_SCAN_DEFAULT_SCHEDULE")
+	if expr == "" {
+		return spec.DefaultSchedule, nil
+	}
+	if _, err := spec.ParseSchedule(expr); err != nil {
+		return "", fmt.Errorf("invalid ECR_SCAN_DEFAULT_SCHEDULE: %w", err)
+	}
+	return expr, nil
+}
+
+// Worker processes the messages of scan runs. Its limiter is shared by all
+// messages the worker processes.
+type Worker struct {
+	Specs   spec.SpecStore
+	Runs    history.RunStore
+	Queue   queue.Queue
+	Limiter *ratelimit.Limiter
+}
+
+// NewWorkerFromEnv returns a worker using the stores, queue and limiter
+// configured in the environment
+func NewWorkerFromEnv(ctx context.Context) (*Worker, error) {
+	specs, err := spec.NewFromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	runs, err := history.NewFromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q, err := queue.NewFromEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := ratelimit.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &Worker{Specs: specs, Runs: runs, Queue: q, Limiter: limiter}, nil
+}
+
+// Handle processes a message. Handling a message again, as queues deliver
+// at least once, leaves a part that was stored successfully untouched.
+// A scan spec disabled or snoozed since the message was sent isn't scanned,
+// its part is recorded without targets.
+// An error means the message should be delivered again, until the queue
+// gives up on it.
+func (w *Worker) Handle(ctx context.Context, body string) error {
+	msg := Message{}
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		return fmt.Errorf("invalid scan message: %w", err)
+	}
+	if len(msg.Pending) > 0 {
+		return w.followUp(ctx, msg)
+	}
+	existing, err := w.Runs.FetchPart(ctx, msg.RunID, msg.SpecID)
+	switch {
+	case err == nil && failureRatio(existing) <= maxFailureRatioFromEnv():
+		fmt.Printf("DEBUG:: scan spec %v of run %v already processed\n", msg.SpecID, msg.RunID)
+		return nil
+	case err != nil && !errors.Is(err, history.ErrNotFound):
+		return err
+	}
+	fmt.Printf("DEBUG:: scanning scan spec %v of run %v\n", msg.SpecID, msg.RunID)
+	report := newReport(history.Part{RunID: msg.RunID, SpecID: msg.SpecID, Results: []history.TargetResult{}}, w.Limiter)
+	pending := []pendingScan{}
+	scanspec, err := w.Specs.Fetch(ctx, msg.SpecID)
+	// scanning stops short of the deadline, so that the part is recorded:
+	work, cancel := reserve(ctx, handOffMargin)
+	defer cancel()
+	switch {
+	case errors.Is(err, spec.ErrNotFound):
+		report.add(history.TargetResult{SpecID: msg.SpecID}, fmt.Errorf("can't load scan spec %v: %w", msg.SpecID, err))
+	case err != nil:
+		return err
+	case !scanspec.Active(time.Now()):
+		fmt.Printf("DEBUG:: skipping scan spec %v of run %v, disabled or snoozed since it was dispatched\n", msg.SpecID, msg.RunID)
+	default:
+		pending = startScan(work, scanspec, msg.Push, w.Limiter, report)
+	}
+	if waitForCompletionFromEnv() {
+		pending = waitForScans(work, pending, w.Limiter, report)
+	} else {
+		pending = nil
+	}
+	err = w.finish(ctx, report, pending, 1)
+	if err != nil {
+		return err
+	}
+	if ratio, tolerated := failureRatio(report.Part), maxFailureRatioFromEnv(); ratio > tolerated {
+		return fmt.Errorf("%.0f%% of the targets of scan spec %v failed, more than the tolerated %.0f%%", ratio*100, msg.SpecID, tolerated*100)
+	}
+	return nil
+}
+
+// WorkOff processes the messages of the run in the in-memory queue, for
+// local runs without SQS
+func WorkOff(ctx context.Context, mem *queue.Memory, run history.Run) error {
+	worker, err := NewWorkerFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+	// follow-ups have to go to the same queue:
+	worker.Queue = mem
+	err = mem.Drain(ctx, queue.DefaultMaxReceives, worker.Handle)
+	if err != nil {
+		return err
+	}
+	if dead := mem.DeadLetters(); len(dead) > 0 {
+		return fmt.Errorf("%v scan messages of run %v failed: %v", len(dead), run.ID, dead)
+	}
+	return nil
+}
+
+// followUp keeps waiting for the scans an earlier message left pending,
+// updating the part with their final status
+func (w *Worker) followUp(ctx context.Context, msg Message) error {
+	fmt.Printf("DEBUG:: waiting for %v scans of scan spec %v of run %v\n", len(msg.Pending), msg.SpecID, msg.RunID)
+	part, err := w.Runs.FetchPart(ctx, msg.RunID, msg.SpecID)
+	if err != nil {
+		return err
+	}
+	report := newReport(part, w.Limiter)
+	pending := []pendingScan{}
+	for _, p := range msg.Pending {
+		if p.Result < 0 || p.Result >= len(report.Results) {
+			fmt.Printf("DEBUG:: ignoring pending scan of unknown result %v\n", p.Result)
+			continue
+		}
+		pending = append(pending, p)
+	}
+	work, cancel := reserve(ctx, handOffMargin)
+	defer cancel()
+	pending = waitForScans(work, pending, w.Limiter, report)
+	return w.finish(ctx, report, pending, msg.FollowUps+1)
+}
+
+// finish stores the part of the report and hands the scans still pending,
+// if any, to a follow-up message with the given number
+func (w *Worker) finish(ctx context.Context, report *Report, pending []pendingScan, followUps int) error {
+	report.finish(time.Now())
+	report.log()
+	err := w.Runs.StorePart(ctx, report.Part)
+	if err != nil {
+		return fmt.Errorf("can't record scan spec %v of run %v: %w", report.SpecID, report.RunID, err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if followUps > maxFollowUps {
+		fmt.Printf("Giving up on %v pending scans of scan spec %v of run %v after %v follow-ups\n", len(pending), report.SpecID, report.RunID, maxFollowUps)
+		return nil
+	}
+	fmt.Printf("DEBUG:: handing %v pending scans of scan spec %v to follow-up %v\n", len(pending), report.SpecID, followUps)
+	followup := Message{RunID: report.RunID, SpecID: report.SpecID, Pending: pending, FollowUps: followUps}
+	if err := followup.send(ctx, w.Queue, pollIntervalFromEnv()); err != nil {
+		fmt.Printf("Can't hand off %v pending scans of scan spec %v of run %v: %v\n", len(pending), report.SpecID, report.RunID, err)
+	}
+	return nil
+}
+
+// startScan starts a scan of every image the scan spec selects, in every
+// repository it covers, or only of the pushed image if push is set,
+// recording the outcome per image in the report rather than stopping at the
+// first error.
+// Every StartImageScan call waits for the limiter of the worker.
+// It returns the scans that were started but haven't completed yet.
+func startScan(ctx context.Context, scanspec spec.ScanSpec, push *ImagePush, limiter *ratelimit.Limiter, report *Report) []pendingScan {
+	base := history.TargetResult{SpecID: scanspec.ID, Region: scanspec.Region, Repository: scanspec.Repository}
+	svc, err := newECR(ctx, scanspec.Region, ecrclient.RoleOf(scanspec))
+	if err != nil {
+		report.add(base, err)
+		return nil
+	}
+	policy := retry.FromEnv()
+	if push != nil {
+		if scanspec.IsDiscovery() {
+			scanspec = scanspec.ForRepository(push.Repository)
+		}
+		return scanImages(ctx, svc, policy, limiter, scanspec, []target.Image{push.image(scanspec)}, report)
+	}
+	repospecs, err := target.Expand(ctx, svc, policy, scanspec)
+	if err != nil {
+		report.add(base, err)
+		return nil
+	}
+	if scanspec.IsDiscovery() {
+		fmt.Printf("DEBUG:: discovered %v repositories for scan spec %v\n", len(repospecs), scanspec.ID)
+	}
+	pending := []pendingScan{}
+	for _, repospec := range repospecs {
+		images, err := target.Resolve(ctx, svc, policy, repospec)
+		if err != nil {
+			report.add(history.TargetResult{SpecID: repospec.ID, Region: repospec.Region, Repository: repospec.Repository}, err)
+			continue
+		}
+		pending = append(pending, scanImages(ctx, svc, policy, limiter, repospec, images, report)...)
+	}
+	return pending
+}
+
+// scanImages starts a scan of each of the images in the repository of the
+// scan spec, skipping images scanned within the freshness window
+func scanImages(ctx context.Context, svc ecrclient.API, policy retry.Policy, limiter *ratelimit.Limiter, scanspec spec.ScanSpec, images []target.Image, report *Report) []pendingScan {
+	scaninput := &ecr.StartImageScanInput{
+		RepositoryName: &scanspec.Repository,
+		RegistryId:     &scanspec.RegistryID,
+	}
+	base := history.TargetResult{
+		SpecID:     scanspec.ID,
+		Region:     scanspec.Region,
+		Repository: scanspec.Repository,
+	}
+	pending := []pendingScan{}
+	fmt.Printf("DEBUG:: scanning %v images for repo %v\n", len(images), scanspec.Repository)
+	window := freshnessWindowFromEnv()
+	for _, img := range images {
+		imgresult := base
+		imgresult.Image = img.Name()
+		if window > 0 {
+			completed, err := lastScanCompleted(ctx, svc, policy, limiter, scanspec, img)
+			if err != nil {
+				fmt.Printf("DEBUG:: can't check last scan of image %v, scanning anyway: %v\n", img.Name(), err)
+			} else if !completed.IsZero() && time.Since(completed) < window {
+				report.skipFresh(imgresult, completed)
+				continue
+			}
+		}
+		scaninput.ImageId = img.ImageID()
+		var result *ecr.StartImageScanOutput
+		err := policy.Do(ctx, func() error {
+			if err := limiter.Wait(ctx, scanspec.Region); err != nil {
+				return err
+			}
+			var err error
+			result, err = svc.StartImageScan(ctx, scaninput)
+			return err
+		})
+		// the scan status is optional, a scan ECR didn't report on is
+		// polled like one in progress:
+		done := false
+		if err == nil && result.ImageScanStatus != nil {
+			imgresult.ScanStatus = string(result.ImageScanStatus.Status)
+			imgresult.ScanStatusDescription = aws.ToString(result.ImageScanStatus.Description)
+			done = scanDone(result.ImageScanStatus.Status)
+		}
+		report.add(imgresult, err)
+		if err == nil {
+			fmt.Printf("DEBUG:: result for image %v: %v\n", img.Name(), result)
+			if !done {
+				pending = append(pending, newPendingScan(len(report.Results)-1, scanspec, scaninput.ImageId))
+			}
+		}
+	}
+	return pending
+}
+
+// lastScanCompleted returns when the last scan of the image completed, or
+// the zero time if the image hasn't been scanned yet
+func lastScanCompleted(ctx context.Context, svc ecrclient.API, policy retry.Policy, limiter *ratelimit.Limiter, scanspec spec.ScanSpec, img target.Image) (time.Time, error) {
+	var result *ecr.DescribeImageScanFindingsOutput
+	err := policy.Do(ctx, func() error {
+		if err := limiter.Wait(ctx, scanspec.Region); err != nil {
+			return err
+		}
+		var err error
+		result, err = svc.DescribeImageScanFindings(ctx, &ecr.DescribeImageScanFindingsInput{
+			RepositoryName: &scanspec.Repository,
+			RegistryId:     &scanspec.RegistryID,
+			ImageId:        img.ImageID(),
+			MaxResults:     aws.Int32(1),
+		})
+		return err
+	})
+	if err != nil {
+		var notfound *types.ScanNotFoundException
+		if errors.As(err, &notfound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if result.ImageScanFindings == nil {
+		return time.Time{}, nil
+	}
+	return aws.ToTime(result.ImageScanFindings.ImageScanCompletedAt), nil
+}
@@ -0,0 +1,539 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/smithy-go"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/history"
+	"ecr.amazon.com/queue"
+	"ecr.amazon.com/ratelimit"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+	"ecr.amazon.com/target"
+)
+
+// dispatchStores returns file stores holding a valid scan spec, due as it
+// never ran, and one whose JSON is corrupt
+func dispatchStores(t *testing.T) (*spec.FileStore, *history.FileStore) {
+	dir := t.TempDir()
+	specs, err := spec.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = specs.Store(context.Background(), spec.ScanSpec{
+		ID:         "valid",
+		Region:     "us-west-2",
+		RegistryID: "148658015984",
+		Repository: "amazonlinux",
+		Tags:       []string{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "corrupt.json"), []byte(`{"id": "corrupt",`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := history.NewFileStore(filepath.Join(dir, "runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return specs, runs
+}
+
+// drained returns the number of messages in the queue
+func drained(t *testing.T, q *queue.Memory) int {
+	n := 0
+	err := q.Drain(context.Background(), 1, func(ctx context.Context, body string) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// checkLoadFailure checks that the run is recorded with the corrupt scan
+// spec as a failed result
+func checkLoadFailure(t *testing.T, runs history.RunStore, run history.Run) {
+	if len(run.Results) != 1 || run.Results[0].SpecID != "corrupt" || run.Results[0].Status != history.StatusFailed {
+		t.Fatalf("run has results %+v, want the corrupt scan spec failed", run.Results)
+	}
+	stored, err := runs.Fetch(context.Background(), run.ID)
+	if err != nil {
+		t.Fatalf("run wasn't recorded: %v", err)
+	}
+	if stored.Counts()[history.StatusFailed] != 1 {
+		t.Errorf("recorded run has counts %v, want 1 failed", stored.Counts())
+	}
+}
+
+func TestDispatchRecordsLoadFailures(t *testing.T) {
+	specs, runs := dispatchStores(t)
+	q := queue.NewMemory()
+	run, err := Dispatch(context.Background(), specs, runs, q, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Specs) != 1 || run.Specs[0] != "valid" {
+		t.Errorf("dispatched %v, want the valid scan spec", run.Specs)
+	}
+	checkLoadFailure(t, runs, run)
+	if n := drained(t, q); n != 1 {
+		t.Errorf("enqueued %v messages, want 1", n)
+	}
+}
+
+func TestDispatchPushRecordsLoadFailures(t *testing.T) {
+	specs, runs := dispatchStores(t)
+	q := queue.NewMemory()
+	push := ImagePush{Region: "us-west-2", RegistryID: "148658015984", Repository: "ubuntu", Digest: pushedDigest, Tag: "22.04"}
+	run, err := DispatchPush(context.Background(), specs, runs, q, push, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Specs) != 0 {
+		t.Errorf("dispatched %v, want no scan spec", run.Specs)
+	}
+	checkLoadFailure(t, runs, run)
+	if n := drained(t, q); n != 0 {
+		t.Errorf("enqueued %v messages, want none", n)
+	}
+}
+
+// fakeECR starts scans with the scan status of the image tagged with the
+// key, or with the key as digest, reporting no status for images missing
+// from statuses and failing with the error in errs if any. The first
+// throttles calls per image are throttled. The images are described on a
+// single page, and polling a scan reports its status in scans, or the next
+// of its statuses in progress, the last of which sticks, and when it
+// completed in completed.
+type fakeECR struct {
+	ecrclient.API
+	statuses  map[string]types.ScanStatus
+	errs      map[string]error
+	throttles int
+	calls     map[string]int
+	images    []types.ImageDetail
+	scans     map[string]types.ScanStatus
+	progress  map[string][]types.ScanStatus
+	completed map[string]time.Time
+	polls     int
+}
+
+// imageKey returns the tag of the image, or its digest if it has no tag
+func imageKey(id *types.ImageIdentifier) string {
+	if id.ImageTag != nil {
+		return *id.ImageTag
+	}
+	return aws.ToString(id.ImageDigest)
+}
+
+func (f *fakeECR) StartImageScan(ctx context.Context, params *ecr.StartImageScanInput, optFns ...func(*ecr.Options)) (*ecr.StartImageScanOutput, error) {
+	if f.calls == nil {
+		f.calls = map[string]int{}
+	}
+	key := imageKey(params.ImageId)
+	f.calls[key]++
+	if f.calls[key] <= f.throttles {
+		return nil, &smithy.OperationError{ServiceID: "ECR", OperationName: "StartImageScan",
+			Err: &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}}
+	}
+	if err := f.errs[key]; err != nil {
+		return nil, err
+	}
+	status, ok := f.statuses[key]
+	if !ok {
+		return &ecr.StartImageScanOutput{ImageId: params.ImageId}, nil
+	}
+	return &ecr.StartImageScanOutput{ImageId: params.ImageId, ImageScanStatus: &types.ImageScanStatus{Status: status}}, nil
+}
+
+func (f *fakeECR) DescribeImages(ctx context.Context, params *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	return &ecr.DescribeImagesOutput{ImageDetails: f.images}, nil
+}
+
+func (f *fakeECR) DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error) {
+	f.polls++
+	key := imageKey(params.ImageId)
+	if completed, ok := f.completed[key]; ok {
+		return &ecr.DescribeImageScanFindingsOutput{
+			ImageScanStatus:   &types.ImageScanStatus{Status: types.ScanStatusComplete},
+			ImageScanFindings: &types.ImageScanFindings{ImageScanCompletedAt: aws.Time(completed)},
+		}, nil
+	}
+	if statuses := f.progress[key]; len(statuses) > 0 {
+		if f.scans == nil {
+			f.scans = map[string]types.ScanStatus{}
+		}
+		f.scans[key] = statuses[0]
+		if len(statuses) > 1 {
+			f.progress[key] = statuses[1:]
+		}
+	}
+	status, ok := f.scans[key]
+	if !ok {
+		return nil, &types.ScanNotFoundException{Message: aws.String("no scan found")}
+	}
+	return &ecr.DescribeImageScanFindingsOutput{ImageScanStatus: &types.ImageScanStatus{Status: status}}, nil
+}
+
+// useECR makes the scans call the fake for the duration of the test
+func useECR(t *testing.T, svc *fakeECR) {
+	saved := newECR
+	newECR = func(ctx context.Context, region string, role ecrclient.Role) (ecrclient.API, error) {
+		return svc, nil
+	}
+	t.Cleanup(func() { newECR = saved })
+}
+
+func TestScanImagesPending(t *testing.T) {
+	svc := &fakeECR{statuses: map[string]types.ScanStatus{
+		"complete":    types.ScanStatusComplete,
+		"in-progress": types.ScanStatusInProgress,
+	}}
+	scanspec := spec.ScanSpec{ID: "app", Region: "us-west-2", RegistryID: "123456789012", Repository: "app"}
+	images := []target.Image{{Tags: []string{"complete"}}, {Tags: []string{"in-progress"}}, {Tags: []string{"no-status"}}}
+	limiter := ratelimit.New(1000, 1000, nil)
+	report := newReport(history.Part{RunID: "run", SpecID: scanspec.ID}, limiter)
+	pending := scanImages(context.Background(), svc, retry.Policy{MaxAttempts: 1}, limiter, scanspec, images, report)
+	if counts := report.Counts(); counts[history.StatusStarted] != 3 {
+		t.Errorf("recorded %v, want 3 started", counts)
+	}
+	if len(pending) != 2 || pending[0].Tag != "in-progress" || pending[1].Tag != "no-status" {
+		t.Errorf("pending %+v, want the scans in progress and without status", pending)
+	}
+}
+
+func TestDispatchMarksEnqueuedSpecs(t *testing.T) {
+	specs, runs := dispatchStores(t)
+	ctx := context.Background()
+	for i := 0; i < 25; i++ {
+		err := specs.Store(ctx, spec.ScanSpec{
+			ID:         fmt.Sprintf("repo-%02d", i),
+			Region:     "us-west-2",
+			RegistryID: "148658015984",
+			Repository: fmt.Sprintf("repo-%02d", i),
+			Tags:       []string{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := queue.NewMemory()
+	run, err := Dispatch(ctx, specs, runs, q, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Specs) != 26 {
+		t.Errorf("dispatched %v scan specs, want 26", len(run.Specs))
+	}
+	for _, scanID := range run.Specs {
+		scanspec, err := specs.Fetch(ctx, scanID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanspec.LastRun == "" {
+			t.Errorf("scan spec %v wasn't marked as run", scanID)
+		}
+	}
+	if n := drained(t, q); n != 26 {
+		t.Errorf("enqueued %v messages, want 26", n)
+	}
+}
+
+func TestScanImagesRetriesThrottling(t *testing.T) {
+	scanspec := spec.ScanSpec{ID: "app", Region: "us-west-2", RegistryID: "123456789012", Repository: "app"}
+	images := []target.Image{{Tags: []string{"v1"}}, {Tags: []string{"v2"}}}
+	tests := []struct {
+		name        string
+		throttles   int
+		maxAttempts int
+		status      history.Status
+	}{
+		{"not throttled", 0, 3, history.StatusStarted},
+		{"throttled until the last attempt", 2, 3, history.StatusStarted},
+		{"throttled beyond the attempts", 3, 3, history.StatusThrottled},
+	}
+	for _, test := range tests {
+		svc := &fakeECR{statuses: map[string]types.ScanStatus{"v1": types.ScanStatusComplete, "v2": types.ScanStatusComplete}, throttles: test.throttles}
+		slept := 0
+		policy := retry.Policy{MaxAttempts: test.maxAttempts, BaseDelay: time.Second, MaxDelay: time.Second,
+			Sleep: func(ctx context.Context, delay time.Duration) error {
+				slept++
+				return nil
+			}}
+		limiter := ratelimit.New(1000, 1000, nil)
+		report := newReport(history.Part{RunID: "run", SpecID: scanspec.ID}, limiter)
+		scanImages(context.Background(), svc, policy, limiter, scanspec, images, report)
+		for _, result := range report.Results {
+			if result.Status != test.status {
+				t.Errorf("%v: image %v is %v, want %v", test.name, result.Image, result.Status, test.status)
+			}
+		}
+		calls := test.throttles + 1
+		if calls > test.maxAttempts {
+			calls = test.maxAttempts
+		}
+		for _, img := range images {
+			if got := svc.calls[img.Tags[0]]; got != calls {
+				t.Errorf("%v: called StartImageScan %v times for %v, want %v", test.name, got, img.Name(), calls)
+			}
+		}
+		if slept != len(images)*(calls-1) {
+			t.Errorf("%v: backed off %v times, want %v", test.name, slept, len(images)*(calls-1))
+		}
+	}
+}
+
+// sentQueue records the messages sent to it
+type sentQueue struct {
+	bodies []string
+	delays []time.Duration
+}
+
+func (q *sentQueue) Send(ctx context.Context, body string, delay time.Duration) error {
+	q.bodies = append(q.bodies, body)
+	q.delays = append(q.delays, delay)
+	return nil
+}
+
+func (q *sentQueue) SendBatch(ctx context.Context, bodies []string) []error {
+	for _, body := range bodies {
+		q.Send(ctx, body, 0)
+	}
+	return make([]error, len(bodies))
+}
+
+// workerFor returns a worker with file stores holding the scan spec "app",
+// selecting the images v1 and v2 of a repository, and a run of it, which
+// it returns along with the fake ECR holding the images
+func workerFor(t *testing.T) (*Worker, history.Run, *fakeECR) {
+	dir := t.TempDir()
+	specs, err := spec.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = specs.Store(ctx, spec.ScanSpec{ID: "app", Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Tags: []string{"v1", "v2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := history.NewFileStore(filepath.Join(dir, "runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := history.NewRun(time.Now())
+	run.Specs = []string{"app"}
+	if err := runs.Store(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	pushed := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	svc := &fakeECR{images: []types.ImageDetail{
+		{ImageDigest: aws.String("sha256:d1"), ImageTags: []string{"v1"}, ImagePushedAt: aws.Time(pushed.Add(time.Hour))},
+		{ImageDigest: aws.String("sha256:d2"), ImageTags: []string{"v2"}, ImagePushedAt: aws.Time(pushed)},
+	}}
+	useECR(t, svc)
+	worker := &Worker{Specs: specs, Runs: runs, Queue: &sentQueue{}, Limiter: ratelimit.New(1000, 1000, nil)}
+	return worker, run, svc
+}
+
+// handle encodes the message and passes it to the worker
+func handle(ctx context.Context, worker *Worker, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return worker.Handle(ctx, string(body))
+}
+
+func TestHandleSkipsRecordedPart(t *testing.T) {
+	worker, run, svc := workerFor(t)
+	ctx := context.Background()
+	// half of the targets failing is still tolerated:
+	recorded := history.Part{RunID: run.ID, SpecID: "app", EndTime: "1792000000", Results: []history.TargetResult{
+		{SpecID: "app", Image: "v1@sha256:d1", Status: history.StatusStarted},
+		{SpecID: "app", Image: "v2@sha256:d2", Status: history.StatusFailed},
+	}}
+	if err := worker.Runs.StorePart(ctx, recorded); err != nil {
+		t.Fatal(err)
+	}
+	if err := handle(ctx, worker, Message{RunID: run.ID, SpecID: "app"}); err != nil {
+		t.Errorf("redelivery failed: %v", err)
+	}
+	if len(svc.calls) != 0 {
+		t.Errorf("redelivery started scans %v", svc.calls)
+	}
+	part, err := worker.Runs.FetchPart(ctx, run.ID, "app")
+	if err != nil || part.EndTime != recorded.EndTime || len(part.Results) != 2 {
+		t.Errorf("redelivery changed the part to %+v, %v", part, err)
+	}
+}
+
+func TestHandleRerunsFailedPart(t *testing.T) {
+	worker, run, svc := workerFor(t)
+	ctx := context.Background()
+	recorded := history.Part{RunID: run.ID, SpecID: "app", EndTime: "1792000000", Results: []history.TargetResult{
+		{SpecID: "app", Image: "v1@sha256:d1", Status: history.StatusFailed},
+		{SpecID: "app", Image: "v2@sha256:d2", Status: history.StatusThrottled},
+	}}
+	if err := worker.Runs.StorePart(ctx, recorded); err != nil {
+		t.Fatal(err)
+	}
+
+	// a re-run failing as much returns an error, to be delivered again:
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}
+	svc.errs = map[string]error{"sha256:d1": denied, "sha256:d2": denied}
+	if err := handle(ctx, worker, Message{RunID: run.ID, SpecID: "app"}); err == nil {
+		t.Error("re-run with all targets failed didn't fail")
+	}
+	if svc.calls["sha256:d1"] != 1 || svc.calls["sha256:d2"] != 1 {
+		t.Errorf("re-run started scans %v, want one per image", svc.calls)
+	}
+	part, err := worker.Runs.FetchPart(ctx, run.ID, "app")
+	if err != nil || part.Counts()[history.StatusFailed] != 2 || part.EndTime == recorded.EndTime {
+		t.Errorf("re-run recorded %+v, %v, want both images failed", part, err)
+	}
+
+	svc.errs = nil
+	if err := handle(ctx, worker, Message{RunID: run.ID, SpecID: "app"}); err != nil {
+		t.Errorf("re-run failed: %v", err)
+	}
+	part, err = worker.Runs.FetchPart(ctx, run.ID, "app")
+	if err != nil || part.Counts()[history.StatusStarted] != 2 || len(part.Results) != 2 {
+		t.Errorf("re-run recorded %+v, %v, want both images started", part, err)
+	}
+}
+
+func TestHandleHandsOffPending(t *testing.T) {
+	defer os.Setenv("ECR_SCAN_WAIT_FOR_COMPLETION", os.Getenv("ECR_SCAN_WAIT_FOR_COMPLETION"))
+	defer os.Setenv("ECR_SCAN_POLL_INTERVAL", os.Getenv("ECR_SCAN_POLL_INTERVAL"))
+	os.Setenv("ECR_SCAN_WAIT_FOR_COMPLETION", "true")
+	os.Setenv("ECR_SCAN_POLL_INTERVAL", "1m")
+	worker, run, svc := workerFor(t)
+	svc.scans = map[string]types.ScanStatus{"sha256:d1": types.ScanStatusComplete, "sha256:d2": types.ScanStatusInProgress}
+	// the invocation ends before the next poll:
+	ctx, cancel := context.WithTimeout(context.Background(), handOffMargin+5*time.Second)
+	defer cancel()
+	if err := handle(ctx, worker, Message{RunID: run.ID, SpecID: "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := worker.Queue.(*sentQueue)
+	if len(sent.bodies) != 1 || sent.delays[0] != time.Minute {
+		t.Fatalf("sent %v with delays %v, want a follow-up after the poll interval", sent.bodies, sent.delays)
+	}
+	followup := Message{}
+	if err := json.Unmarshal([]byte(sent.bodies[0]), &followup); err != nil {
+		t.Fatal(err)
+	}
+	if followup.RunID != run.ID || followup.SpecID != "app" || followup.FollowUps != 1 ||
+		len(followup.Pending) != 1 || followup.Pending[0].Digest != "sha256:d2" || followup.Pending[0].Result != 1 {
+		t.Errorf("follow-up %+v, want the scan of v2 pending", followup)
+	}
+	part, err := worker.Runs.FetchPart(context.Background(), run.ID, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.Results[0].ScanStatus != string(types.ScanStatusComplete) || part.Results[1].ScanStatus != string(types.ScanStatusInProgress) {
+		t.Errorf("recorded %+v, want the scan of v1 complete and of v2 in progress", part.Results)
+	}
+}
+
+func TestScanImagesSkipsRecentlyScanned(t *testing.T) {
+	defer os.Setenv("ECR_SCAN_FRESHNESS_WINDOW", os.Getenv("ECR_SCAN_FRESHNESS_WINDOW"))
+	scanspec := spec.ScanSpec{ID: "app", Region: "us-west-2", RegistryID: "123456789012", Repository: "app"}
+	images := []target.Image{{Tags: []string{"fresh"}}, {Tags: []string{"stale"}}, {Tags: []string{"unscanned"}}, {Tags: []string{"limited"}}}
+	limitExceeded := &smithy.OperationError{ServiceID: "ECR", OperationName: "StartImageScan",
+		Err: &types.LimitExceededException{Message: aws.String("The scan quota per image has been exceeded. Wait and try again.")}}
+	tests := []struct {
+		name       string
+		window     string
+		skipped    []string
+		started    []string
+		freshScans int
+	}{
+		{"without pre-check", "", []string{"limited"}, []string{"fresh", "stale", "unscanned"}, 1},
+		{"within the window", "6h", []string{"fresh", "limited"}, []string{"stale", "unscanned"}, 0},
+	}
+	for _, test := range tests {
+		os.Setenv("ECR_SCAN_FRESHNESS_WINDOW", test.window)
+		svc := &fakeECR{
+			errs: map[string]error{"limited": limitExceeded},
+			completed: map[string]time.Time{
+				"fresh":   time.Now().Add(-time.Hour),
+				"stale":   time.Now().Add(-12 * time.Hour),
+				"limited": time.Now().Add(-12 * time.Hour),
+			},
+		}
+		limiter := ratelimit.New(1000, 1000, nil)
+		report := newReport(history.Part{RunID: "run", SpecID: scanspec.ID}, limiter)
+		scanImages(context.Background(), svc, retry.Policy{MaxAttempts: 3}, limiter, scanspec, images, report)
+		skipped, started := []string{}, []string{}
+		for _, result := range report.Results {
+			switch result.Status {
+			case history.StatusSkippedRecentlyScanned:
+				skipped = append(skipped, result.Image)
+			case history.StatusStarted:
+				started = append(started, result.Image)
+			default:
+				t.Errorf("%v: image %v is %v: %v", test.name, result.Image, result.Status, result.Error)
+			}
+		}
+		if fmt.Sprint(skipped) != fmt.Sprint(test.skipped) || fmt.Sprint(started) != fmt.Sprint(test.started) {
+			t.Errorf("%v: skipped %v and started %v, want %v and %v", test.name, skipped, started, test.skipped, test.started)
+		}
+		// the scan quota isn't retried, and fresh images aren't scanned:
+		if svc.calls["limited"] != 1 || svc.calls["fresh"] != test.freshScans {
+			t.Errorf("%v: started scans %v", test.name, svc.calls)
+		}
+		if failures := failureRatio(report.Part); failures != 0 {
+			t.Errorf("%v: failure ratio %v, want skipped images not to count", test.name, failures)
+		}
+	}
+}
+
+func TestHandleSkipsInactiveSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(ss *spec.ScanSpec)
+	}{
+		{"disabled", func(ss *spec.ScanSpec) { ss.Enabled = aws.Bool(false) }},
+		{"snoozed", func(ss *spec.ScanSpec) { ss.SnoozeUntil = time.Now().Add(time.Hour).UTC().Format(time.RFC3339) }},
+	}
+	for _, test := range tests {
+		worker, run, svc := workerFor(t)
+		ctx := context.Background()
+		// the scan spec changed after the message was sent:
+		scanspec, err := worker.Specs.Fetch(ctx, "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.edit(&scanspec)
+		if err := worker.Specs.Store(ctx, scanspec); err != nil {
+			t.Fatal(err)
+		}
+		if err := handle(ctx, worker, Message{RunID: run.ID, SpecID: "app"}); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+		if len(svc.calls) != 0 {
+			t.Errorf("%v: started scans %v", test.name, svc.calls)
+		}
+		part, err := worker.Runs.FetchPart(ctx, run.ID, "app")
+		if err != nil || len(part.Results) != 0 {
+			t.Errorf("%v: recorded %+v, %v, want a part without targets", test.name, part, err)
+		}
+	}
+}
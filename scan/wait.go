@@ -0,0 +1,162 @@
+package scan
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/ratelimit"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+const (
+	// defaultPollInterval is the time between two polls of the pending
+	// scans unless overridden by ECR_SCAN_POLL_INTERVAL
+	defaultPollInterval = 15 * time.Second
+	// handOffMargin is the time kept free before the Lambda deadline to
+	// record the part and hand pending scans to a follow-up message
+	handOffMargin = 10 * time.Second
+	// maxFollowUps bounds the chain of follow-up messages of a scan spec, so
+	// that a scan stuck in progress doesn't keep the workers busy forever
+	maxFollowUps = 10
+)
+
+// pendingScan is a started scan whose completion hasn't been seen yet
+type pendingScan struct {
+	// Result is the index of the scan in the results of the part
+	Result     int    `json:"result"`
+	Region     string `json:"region"`
+	RegistryID string `json:"registry"`
+	Repository string `json:"repository"`
+	Digest     string `json:"digest,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	// Role is the role the scan was started with
+	ecrclient.Role
+}
+
+// waitForCompletionFromEnv returns whether ECR_SCAN_WAIT_FOR_COMPLETION
+// enables polling started scans until they complete
+func waitForCompletionFromEnv() bool {
+	wait, err := strconv.ParseBool(os.Getenv("ECR_SCAN_WAIT_FOR_COMPLETION"))
+	return err == nil && wait
+}
+
+// pollIntervalFromEnv returns the interval set in ECR_SCAN_POLL_INTERVAL
+func pollIntervalFromEnv() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("ECR_SCAN_POLL_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultPollInterval
+	}
+	return interval
+}
+
+// newPendingScan returns the pending scan of the image whose result is at
+// the given index of the part
+func newPendingScan(index int, scanspec spec.ScanSpec, imageid *types.ImageIdentifier) pendingScan {
+	return pendingScan{
+		Result:     index,
+		Region:     scanspec.Region,
+		RegistryID: scanspec.RegistryID,
+		Repository: scanspec.Repository,
+		Digest:     aws.ToString(imageid.ImageDigest),
+		Tag:        aws.ToString(imageid.ImageTag),
+		Role:       ecrclient.RoleOf(scanspec),
+	}
+}
+
+// imageID returns the identifier to pass to ECR for the pending scan
+func (p pendingScan) imageID() *types.ImageIdentifier {
+	if p.Digest != "" {
+		return &types.ImageIdentifier{ImageDigest: aws.String(p.Digest)}
+	}
+	return &types.ImageIdentifier{ImageTag: aws.String(p.Tag)}
+}
+
+// scanDone reports whether a scan with the given status has come to an end
+func scanDone(status types.ScanStatus) bool {
+	return status == types.ScanStatusComplete || status == types.ScanStatusFailed
+}
+
+// reserve returns a context whose deadline comes the margin before that of
+// ctx, if it has one, so that the work done with it leaves the margin to
+// the caller
+func reserve(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// waitForScans polls the pending scans until each of them is COMPLETE or
+// FAILED, recording the final scan status in the report. It stops polling
+// once the deadline of the context has passed, before any describe call,
+// or the next poll wouldn't start before it, and returns the scans still
+// pending. Callers pass a context reserving the time to hand off.
+func waitForScans(ctx context.Context, pending []pendingScan, limiter *ratelimit.Limiter, report *Report) []pendingScan {
+	policy := retry.FromEnv()
+	interval := pollIntervalFromEnv()
+	for len(pending) > 0 {
+		stillPending := []pendingScan{}
+		for i, p := range pending {
+			if ctx.Err() != nil {
+				fmt.Printf("DEBUG:: deadline reached, leaving %v scans pending\n", len(pending)-i)
+				stillPending = append(stillPending, pending[i:]...)
+				break
+			}
+			var result *ecr.DescribeImageScanFindingsOutput
+			svc, err := newECR(ctx, p.Region, p.Role)
+			if err != nil {
+				fmt.Printf("DEBUG:: can't poll scan of %v: %v\n", report.Results[p.Result].Image, err)
+				stillPending = append(stillPending, p)
+				continue
+			}
+			err = policy.Do(ctx, func() error {
+				if err := limiter.Wait(ctx, p.Region); err != nil {
+					return err
+				}
+				var err error
+				result, err = svc.DescribeImageScanFindings(ctx, &ecr.DescribeImageScanFindingsInput{
+					RepositoryName: aws.String(p.Repository),
+					RegistryId:     aws.String(p.RegistryID),
+					ImageId:        p.imageID(),
+					MaxResults:     aws.Int32(1),
+				})
+				return err
+			})
+			if err != nil || result.ImageScanStatus == nil {
+				fmt.Printf("DEBUG:: can't poll scan of %v: %v\n", report.Results[p.Result].Image, err)
+				stillPending = append(stillPending, p)
+				continue
+			}
+			imgresult := &report.Results[p.Result]
+			imgresult.ScanStatus = string(result.ImageScanStatus.Status)
+			imgresult.ScanStatusDescription = aws.ToString(result.ImageScanStatus.Description)
+			if !scanDone(result.ImageScanStatus.Status) {
+				stillPending = append(stillPending, p)
+			}
+		}
+		pending = stillPending
+		if len(pending) == 0 {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < interval {
+			break
+		}
+		fmt.Printf("DEBUG:: %v scans pending, polling again in %v\n", len(pending), interval)
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-time.After(interval):
+		}
+	}
+	return pending
+}
@@ -0,0 +1,148 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/history"
+	"ecr.amazon.com/ratelimit"
+)
+
+func TestReserve(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	work, cancelWork := reserve(ctx, handOffMargin)
+	defer cancelWork()
+	if got, ok := work.Deadline(); !ok || !got.Equal(deadline.Add(-handOffMargin)) {
+		t.Errorf("reserved deadline %v, want %v", got, deadline.Add(-handOffMargin))
+	}
+
+	unbounded, cancelUnbounded := reserve(context.Background(), handOffMargin)
+	defer cancelUnbounded()
+	if got, ok := unbounded.Deadline(); ok {
+		t.Errorf("reserved deadline %v without a deadline to reserve from", got)
+	}
+}
+
+func TestWaitForScansStopsAtDeadline(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Hour))
+	defer cancel()
+	// the work context is up while the invocation still has time to hand off:
+	work, cancelWork := reserve(ctx, 2*time.Hour)
+	defer cancelWork()
+	limiter := ratelimit.New(1000, 1000, nil)
+	report := newReport(history.Part{RunID: "run", SpecID: "app", Results: []history.TargetResult{
+		{SpecID: "app", Image: "v1", Status: history.StatusStarted, ScanStatus: "IN_PROGRESS"},
+		{SpecID: "app", Image: "v2", Status: history.StatusStarted, ScanStatus: "IN_PROGRESS"},
+	}}, limiter)
+	pending := []pendingScan{
+		{Result: 0, Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Tag: "v1"},
+		{Result: 1, Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Tag: "v2"},
+	}
+	left := waitForScans(work, pending, limiter, report)
+	if len(left) != 2 || left[0].Tag != "v1" || left[1].Tag != "v2" {
+		t.Errorf("left %+v pending, want both scans", left)
+	}
+	if ctx.Err() != nil {
+		t.Error("waiting used up the time reserved to hand off")
+	}
+	for _, result := range report.Results {
+		if result.ScanStatus != "IN_PROGRESS" {
+			t.Errorf("result %+v changed without polling", result)
+		}
+	}
+}
+
+func TestWaitForScansUntilDone(t *testing.T) {
+	defer os.Setenv("ECR_SCAN_POLL_INTERVAL", os.Getenv("ECR_SCAN_POLL_INTERVAL"))
+	os.Setenv("ECR_SCAN_POLL_INTERVAL", "1ms")
+	svc := &fakeECR{progress: map[string][]types.ScanStatus{
+		"sha256:d1": {types.ScanStatusInProgress, types.ScanStatusInProgress, types.ScanStatusComplete},
+		"sha256:d2": {types.ScanStatusInProgress, types.ScanStatusFailed},
+	}}
+	useECR(t, svc)
+	limiter := ratelimit.New(1000, 1000, nil)
+	report := newReport(history.Part{RunID: "run", SpecID: "app", Results: []history.TargetResult{
+		{SpecID: "app", Image: "v1@sha256:d1", Status: history.StatusStarted},
+		{SpecID: "app", Image: "v2@sha256:d2", Status: history.StatusStarted},
+	}}, limiter)
+	pending := []pendingScan{
+		{Result: 0, Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Digest: "sha256:d1"},
+		{Result: 1, Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Digest: "sha256:d2"},
+	}
+	if left := waitForScans(context.Background(), pending, limiter, report); len(left) != 0 {
+		t.Errorf("left %+v pending, want none", left)
+	}
+	if report.Results[0].ScanStatus != string(types.ScanStatusComplete) || report.Results[1].ScanStatus != string(types.ScanStatusFailed) {
+		t.Errorf("recorded %+v, want the scan of v1 complete and of v2 failed", report.Results)
+	}
+	// a scan is no longer polled once done:
+	if svc.polls != 5 {
+		t.Errorf("polled %v times, want 5", svc.polls)
+	}
+}
+
+func TestFollowUpCarriesPending(t *testing.T) {
+	defer os.Setenv("ECR_SCAN_POLL_INTERVAL", os.Getenv("ECR_SCAN_POLL_INTERVAL"))
+	os.Setenv("ECR_SCAN_POLL_INTERVAL", "1m")
+	worker, run, svc := workerFor(t)
+	svc.scans = map[string]types.ScanStatus{"sha256:d1": types.ScanStatusComplete, "sha256:d2": types.ScanStatusInProgress}
+	part := history.Part{RunID: run.ID, SpecID: "app", Results: []history.TargetResult{
+		{SpecID: "app", Image: "v1@sha256:d1", Status: history.StatusStarted, ScanStatus: "IN_PROGRESS"},
+		{SpecID: "app", Image: "v2@sha256:d2", Status: history.StatusStarted, ScanStatus: "IN_PROGRESS"},
+	}}
+	if err := worker.Runs.StorePart(context.Background(), part); err != nil {
+		t.Fatal(err)
+	}
+	pending := []pendingScan{
+		{Result: 0, Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Digest: "sha256:d1"},
+		{Result: 1, Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Digest: "sha256:d2"},
+	}
+	tests := []struct {
+		name      string
+		followUps int
+		next      int
+	}{
+		{"follow-up", 1, 2},
+		{"last follow-up", maxFollowUps, 0},
+	}
+	for _, test := range tests {
+		sent := &sentQueue{}
+		worker.Queue = sent
+		ctx, cancel := context.WithTimeout(context.Background(), handOffMargin+5*time.Second)
+		err := handle(ctx, worker, Message{RunID: run.ID, SpecID: "app", Pending: pending, FollowUps: test.followUps})
+		cancel()
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		stored, err := worker.Runs.FetchPart(context.Background(), run.ID, "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Results[0].ScanStatus != string(types.ScanStatusComplete) || stored.Results[1].ScanStatus != string(types.ScanStatusInProgress) {
+			t.Errorf("%v: recorded %+v, want the scan of v1 complete", test.name, stored.Results)
+		}
+		if test.next == 0 {
+			if len(sent.bodies) != 0 {
+				t.Errorf("%v: sent %v, want to give up", test.name, sent.bodies)
+			}
+			continue
+		}
+		if len(sent.bodies) != 1 {
+			t.Fatalf("%v: sent %v, want a follow-up", test.name, sent.bodies)
+		}
+		followup := Message{}
+		if err := json.Unmarshal([]byte(sent.bodies[0]), &followup); err != nil {
+			t.Fatal(err)
+		}
+		if followup.FollowUps != test.next || len(followup.Pending) != 1 || followup.Pending[0] != pending[1] {
+			t.Errorf("%v: follow-up %+v, want number %v with the scan of v2 pending", test.name, followup, test.next)
+		}
+	}
+}
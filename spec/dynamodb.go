@@ -0,0 +1,265 @@
+package spec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"ecr.amazon.com/internal/store"
+	"ecr.amazon.com/retry"
+)
+
+// DynamoDBStore keeps each scan spec as an item in a table with the
+// string partition key "id". The spec fields are stored as top-level
+// attributes, so the table can be queried by region, registry or
+// repository without going through the store.
+type DynamoDBStore struct {
+	client *dynamodb.Client
+	table  string
+	policy retry.Policy
+}
+
+// NewDynamoDBStore returns a store for the scan specs in the given table
+func NewDynamoDBStore(ctx context.Context, table string) (*DynamoDBStore, error) {
+	if table == "" {
+		return nil, fmt.Errorf("no scan config table provided")
+	}
+	cfg, err := store.LoadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &DynamoDBStore{
+		client: dynamodb.NewFromConfig(cfg),
+		table:  table,
+		policy: retry.FromEnv(),
+	}, nil
+}
+
+// the attribute names follow the JSON field names of ScanSpec
+func jsonTagKey(o *attributevalue.EncoderOptions)    { o.TagKey = "json" }
+func jsonTagKeyDec(o *attributevalue.DecoderOptions) { o.TagKey = "json" }
+
+func (st *DynamoDBStore) key(scanid string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: scanid},
+	}
+}
+
+// Store puts the scan spec into the table
+func (st *DynamoDBStore) Store(ctx context.Context, scanspec ScanSpec) error {
+	input, err := st.putInput(scanspec)
+	if err != nil {
+		return err
+	}
+	return st.putItem(ctx, input)
+}
+
+// StoreIf puts the scan spec into the table on the condition that the
+// stored item has the given revision and last run
+func (st *DynamoDBStore) StoreIf(ctx context.Context, scanspec ScanSpec, revision int) error {
+	input, err := st.putInput(scanspec)
+	if err != nil {
+		return err
+	}
+	input.ExpressionAttributeValues = revisionValue(revision)
+	if scanspec.LastRun == "" {
+		input.ConditionExpression = aws.String("revision = :revision AND attribute_not_exists(lastRun)")
+	} else {
+		input.ConditionExpression = aws.String("revision = :revision AND lastRun = :lastRun")
+		input.ExpressionAttributeValues[":lastRun"] = &types.AttributeValueMemberS{Value: scanspec.LastRun}
+	}
+	return conflictError(st.putItem(ctx, input))
+}
+
+// MarkRun updates just the lastRun attribute of the scan spec
+func (st *DynamoDBStore) MarkRun(ctx context.Context, scanid string, lastRun string) error {
+	err := st.policy.Do(ctx, func() error {
+		_, err := st.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(st.table),
+			Key:                 st.key(scanid),
+			UpdateExpression:    aws.String("SET lastRun = :lastRun"),
+			ConditionExpression: aws.String("attribute_exists(id)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":lastRun": &types.AttributeValueMemberS{Value: lastRun},
+			},
+		})
+		return err
+	})
+	if errors.Is(conflictError(err), ErrConflict) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// putItem puts the item, retrying according to the policy of the store
+func (st *DynamoDBStore) putItem(ctx context.Context, input *dynamodb.PutItemInput) error {
+	return st.policy.Do(ctx, func() error {
+		_, err := st.client.PutItem(ctx, input)
+		return err
+	})
+}
+
+// deleteItem deletes the item, retrying according to the policy of the store
+func (st *DynamoDBStore) deleteItem(ctx context.Context, input *dynamodb.DeleteItemInput) error {
+	return st.policy.Do(ctx, func() error {
+		_, err := st.client.DeleteItem(ctx, input)
+		return err
+	})
+}
+
+func (st *DynamoDBStore) putInput(scanspec ScanSpec) (*dynamodb.PutItemInput, error) {
+	av, err := attributevalue.NewEncoder(jsonTagKey).Encode(scanspec)
+	if err != nil {
+		return nil, err
+	}
+	item, ok := av.(*types.AttributeValueMemberM)
+	if !ok {
+		return nil, fmt.Errorf("can't store scan spec %v as DynamoDB item", scanspec.ID)
+	}
+	return &dynamodb.PutItemInput{
+		TableName: aws.String(st.table),
+		Item:      item.Value,
+	}, nil
+}
+
+func revisionValue(revision int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":revision": &types.AttributeValueMemberN{Value: strconv.Itoa(revision)},
+	}
+}
+
+// conflictError turns a failed condition into ErrConflict
+func conflictError(err error) error {
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Fetch reads the scan spec with the given ID from the table
+func (st *DynamoDBStore) Fetch(ctx context.Context, scanid string) (ScanSpec, error) {
+	ss := ScanSpec{}
+	var resp *dynamodb.GetItemOutput
+	err := st.policy.Do(ctx, func() error {
+		var err error
+		resp, err = st.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(st.table),
+			Key:            st.key(scanid),
+			ConsistentRead: aws.Bool(true),
+		})
+		return err
+	})
+	if err != nil {
+		return ss, err
+	}
+	if resp.Item == nil {
+		return ss, ErrNotFound
+	}
+	err = attributevalue.NewDecoder(jsonTagKeyDec).Decode(&types.AttributeValueMemberM{Value: resp.Item}, &ss)
+	if err != nil {
+		return ss, err
+	}
+	return ss, nil
+}
+
+// Remove deletes the scan spec with the given ID from the table
+func (st *DynamoDBStore) Remove(ctx context.Context, scanid string) error {
+	return st.deleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(st.table),
+		Key:       st.key(scanid),
+	})
+}
+
+// RemoveIf deletes the scan spec with the given ID from the table on the
+// condition that it has the given revision
+func (st *DynamoDBStore) RemoveIf(ctx context.Context, scanid string, revision int) error {
+	err := st.deleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(st.table),
+		Key:                       st.key(scanid),
+		ConditionExpression:       aws.String("revision = :revision"),
+		ExpressionAttributeValues: revisionValue(revision),
+	})
+	return conflictError(err)
+}
+
+// IDs scans the table for the IDs of all scan specs
+func (st *DynamoDBStore) IDs(ctx context.Context) ([]string, error) {
+	return allIDs(ctx, st)
+}
+
+// Page scans the table for up to limit scan spec IDs. The cursor wraps
+// the ID of the last evaluated item.
+func (st *DynamoDBStore) Page(ctx context.Context, limit int, cursor string) ([]string, string, error) {
+	items, next, err := st.scan(ctx, limit, cursor, aws.String("id"))
+	if err != nil {
+		return nil, "", err
+	}
+	ids := []string{}
+	for _, item := range items {
+		if id, ok := item["id"].(*types.AttributeValueMemberS); ok {
+			ids = append(ids, id.Value)
+		}
+	}
+	return ids, next, nil
+}
+
+// List scans the table for up to limit scan specs, taking them from the
+// items the scan returns rather than fetching each of them again
+func (st *DynamoDBStore) List(ctx context.Context, limit int, cursor string) ([]Result, string, error) {
+	items, next, err := st.scan(ctx, limit, cursor, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	results := []Result{}
+	for _, item := range items {
+		id, ok := item["id"].(*types.AttributeValueMemberS)
+		if !ok {
+			continue
+		}
+		ss := ScanSpec{}
+		err := attributevalue.NewDecoder(jsonTagKeyDec).Decode(&types.AttributeValueMemberM{Value: item}, &ss)
+		results = append(results, Result{ID: id.Value, Spec: ss, Err: err})
+	}
+	return results, next, nil
+}
+
+// scan returns a page of up to limit items, with only the attributes in
+// the projection expression if given, and the cursor of the next page
+func (st *DynamoDBStore) scan(ctx context.Context, limit int, cursor string, projection *string) ([]map[string]types.AttributeValue, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(st.table),
+		ProjectionExpression: projection,
+		ConsistentRead:       aws.Bool(true),
+	}
+	if limit > 0 {
+		input.Limit = aws.Int32(int32(limit))
+	}
+	if cursor != "" {
+		lastID, err := store.DecodeCursor(cursor, ErrInvalidCursor)
+		if err != nil {
+			return nil, "", err
+		}
+		input.ExclusiveStartKey = st.key(lastID)
+	}
+	var resp *dynamodb.ScanOutput
+	err := st.policy.Do(ctx, func() error {
+		var err error
+		resp, err = st.client.Scan(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	lastID, ok := resp.LastEvaluatedKey["id"].(*types.AttributeValueMemberS)
+	if !ok {
+		return resp.Items, "", nil
+	}
+	return resp.Items, store.EncodeCursor(lastID.Value), nil
+}
@@ -0,0 +1,76 @@
+package spec
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"ecr.amazon.com/retry"
+)
+
+// stubDynamoDB throttles the first throttles calls, then answers GetItem
+// with a scan spec and fails the condition of any other call
+type stubDynamoDB struct {
+	throttles int
+	calls     int
+}
+
+func (stub *stubDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.calls++
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	switch {
+	case stub.calls <= stub.throttles:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type": "com.amazonaws.dynamodb.v20120810#ProvisionedThroughputExceededException", "message": "Rate exceeded"}`))
+	case r.Header.Get("X-Amz-Target") == "DynamoDB_20120810.GetItem":
+		w.Write([]byte(`{"Item": {"id": {"S": "app"}, "repository": {"S": "app"}, "revision": {"N": "2"}}}`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type": "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException", "message": "The conditional request failed"}`))
+	}
+}
+
+// newStubDynamoDBStore returns a DynamoDB store calling the stub
+func newStubDynamoDBStore(t *testing.T, stub *stubDynamoDB, policy retry.Policy) *DynamoDBStore {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-west-2",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: dynamodb.EndpointResolverFromURL(server.URL),
+		Retryer:          aws.NopRetryer{},
+		// the stub doesn't checksum its responses:
+		DisableValidateResponseChecksum: true,
+	})
+	return &DynamoDBStore{client: client, table: "ecr-continuous-scan-config", policy: policy}
+}
+
+func TestDynamoDBStoreRetriesThrottling(t *testing.T) {
+	policy := retry.Policy{MaxAttempts: 3, Sleep: func(ctx context.Context, delay time.Duration) error { return nil }}
+	ctx := context.Background()
+
+	stub := &stubDynamoDB{throttles: 2}
+	st := newStubDynamoDBStore(t, stub, policy)
+	if ss, err := st.Fetch(ctx, "app"); err != nil || ss.Repository != "app" || ss.Revision != 2 || stub.calls != 3 {
+		t.Errorf("Fetch = %+v, %v after %v calls, want the scan spec after 3 calls", ss, err, stub.calls)
+	}
+
+	stub = &stubDynamoDB{throttles: 3}
+	st = newStubDynamoDBStore(t, stub, policy)
+	if _, err := st.Fetch(ctx, "app"); !retry.IsThrottle(err) || stub.calls != 3 {
+		t.Errorf("Fetch returned %v after %v calls, want throttling after 3 calls", err, stub.calls)
+	}
+
+	// a failed condition is final, and still a conflict after throttling:
+	stub = &stubDynamoDB{throttles: 1}
+	st = newStubDynamoDBStore(t, stub, policy)
+	if err := st.RemoveIf(ctx, "app", 1); !errors.Is(err, ErrConflict) || stub.calls != 2 {
+		t.Errorf("RemoveIf returned %v after %v calls, want ErrConflict after 2 calls", err, stub.calls)
+	}
+}
@@ -0,0 +1,206 @@
+package spec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"ecr.amazon.com/internal/store"
+)
+
+// FileStore keeps each scan spec as a JSON file named after its ID in a
+// local directory, which is handy for running the functions locally
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store for the scan specs in the given directory,
+// creating it if necessary
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no scan config directory provided")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (st *FileStore) path(scanid string) string {
+	return filepath.Join(st.dir, filepath.Base(scanid)+".json")
+}
+
+// Store writes the scan spec to its file
+func (st *FileStore) Store(ctx context.Context, scanspec ScanSpec) error {
+	ssjson, err := json.MarshalIndent(scanspec, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so readers never see a partial spec:
+	tmp, err := ioutil.TempFile(st.dir, ".spec-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(ssjson)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path(scanspec.ID))
+}
+
+// StoreIf writes the scan spec to its file if the stored one has the given
+// revision, holding the lock of the scan spec in between
+func (st *FileStore) StoreIf(ctx context.Context, scanspec ScanSpec, revision int) error {
+	unlock, err := store.Lock(ctx, st.dir, scanspec.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := st.checkRevision(ctx, scanspec.ID, revision)
+	if err != nil {
+		return err
+	}
+	if current.LastRun != scanspec.LastRun {
+		return ErrConflict
+	}
+	return st.Store(ctx, scanspec)
+}
+
+// MarkRun sets the last run of the scan spec, holding the lock of the scan
+// spec while doing so
+func (st *FileStore) MarkRun(ctx context.Context, scanid string, lastRun string) error {
+	unlock, err := store.Lock(ctx, st.dir, scanid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ss, err := st.Fetch(ctx, scanid)
+	if err != nil {
+		return err
+	}
+	ss.LastRun = lastRun
+	return st.Store(ctx, ss)
+}
+
+// checkRevision returns the scan spec with the given ID if it has the given
+// revision, and ErrConflict otherwise
+func (st *FileStore) checkRevision(ctx context.Context, scanid string, revision int) (ScanSpec, error) {
+	current, err := st.Fetch(ctx, scanid)
+	if errors.Is(err, ErrNotFound) {
+		return current, ErrConflict
+	}
+	if err != nil {
+		return current, err
+	}
+	if current.Revision != revision {
+		return current, ErrConflict
+	}
+	return current, nil
+}
+
+// Fetch reads the scan spec with the given ID from its file
+func (st *FileStore) Fetch(ctx context.Context, scanid string) (ScanSpec, error) {
+	ss := ScanSpec{}
+	ssjson, err := ioutil.ReadFile(st.path(scanid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ss, ErrNotFound
+		}
+		return ss, err
+	}
+	err = json.Unmarshal(ssjson, &ss)
+	if err != nil {
+		return ss, err
+	}
+	return ss, nil
+}
+
+// Remove deletes the file of the scan spec with the given ID
+func (st *FileStore) Remove(ctx context.Context, scanid string) error {
+	err := os.Remove(st.path(scanid))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveIf deletes the file of the scan spec with the given ID if it has the
+// given revision, holding the lock of the scan spec in between
+func (st *FileStore) RemoveIf(ctx context.Context, scanid string, revision int) error {
+	unlock, err := store.Lock(ctx, st.dir, scanid)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = st.checkRevision(ctx, scanid, revision)
+	if err != nil {
+		return err
+	}
+	return st.Remove(ctx, scanid)
+}
+
+// IDs lists all scan spec files in the directory, ordered by name
+func (st *FileStore) IDs(ctx context.Context) ([]string, error) {
+	return allIDs(ctx, st)
+}
+
+// List reads up to limit scan spec files, in parallel
+func (st *FileStore) List(ctx context.Context, limit int, cursor string) ([]Result, string, error) {
+	return loadPage(ctx, st, limit, cursor)
+}
+
+// Page lists up to limit scan spec files in the directory, ordered by
+// name. The cursor wraps the last ID returned.
+func (st *FileStore) Page(ctx context.Context, limit int, cursor string) ([]string, string, error) {
+	lastID := ""
+	if cursor != "" {
+		var err error
+		lastID, err = store.DecodeCursor(cursor, ErrInvalidCursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	ids, err := st.list()
+	if err != nil {
+		return nil, "", err
+	}
+	start := sort.SearchStrings(ids, lastID)
+	if start < len(ids) && ids[start] == lastID {
+		start++
+	}
+	ids = ids[start:]
+	if limit <= 0 || len(ids) <= limit {
+		return ids, "", nil
+	}
+	ids = ids[:limit]
+	return ids, store.EncodeCursor(ids[limit-1]), nil
+}
+
+// list returns the IDs of all scan spec files in the directory, ordered by name
+func (st *FileStore) list() ([]string, error) {
+	entries, err := ioutil.ReadDir(st.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		fn := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(fn, ".") || !strings.HasSuffix(fn, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(fn, ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,128 @@
+package spec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ecr.amazon.com/internal/store"
+)
+
+func TestFileStoreConflicts(t *testing.T) {
+	st, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	stored := ScanSpec{ID: "app", Region: "us-west-2", RegistryID: "123456789012", Repository: "app", Revision: 2}
+	if err := st.Store(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	next := stored
+	next.Revision = 3
+
+	if err := st.StoreIf(ctx, next, 1); !errors.Is(err, ErrConflict) {
+		t.Errorf("StoreIf on a stale revision returned %v, want ErrConflict", err)
+	}
+	missing := next
+	missing.ID = "missing"
+	if err := st.StoreIf(ctx, missing, 2); !errors.Is(err, ErrConflict) {
+		t.Errorf("StoreIf of a missing scan spec returned %v, want ErrConflict", err)
+	}
+	// a run marked in between changes the scan spec too:
+	if err := st.MarkRun(ctx, "app", "1792000000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.StoreIf(ctx, next, 2); !errors.Is(err, ErrConflict) {
+		t.Errorf("StoreIf without the last run returned %v, want ErrConflict", err)
+	}
+	next.LastRun = "1792000000"
+	if err := st.StoreIf(ctx, next, 2); err != nil {
+		t.Errorf("StoreIf on the current revision returned %v", err)
+	}
+	if fetched, err := st.Fetch(ctx, "app"); err != nil || fetched.Revision != 3 {
+		t.Errorf("Fetch returned revision %v, %v, want 3", fetched.Revision, err)
+	}
+
+	if err := st.RemoveIf(ctx, "app", 2); !errors.Is(err, ErrConflict) {
+		t.Errorf("RemoveIf on a stale revision returned %v, want ErrConflict", err)
+	}
+	if err := st.RemoveIf(ctx, "missing", 0); !errors.Is(err, ErrConflict) {
+		t.Errorf("RemoveIf of a missing scan spec returned %v, want ErrConflict", err)
+	}
+	if err := st.RemoveIf(ctx, "app", 3); err != nil {
+		t.Errorf("RemoveIf on the current revision returned %v", err)
+	}
+	if _, err := st.Fetch(ctx, "app"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch after RemoveIf returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileStorePage(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ids := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for _, id := range ids {
+		if err := st.Store(ctx, ScanSpec{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// lock files and subdirectories aren't scan specs:
+	if _, err := store.Lock(ctx, st.dir, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "runs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{1, 2, 3, 7, 8} {
+		listed := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(ids) {
+				t.Fatalf("limit %v: cursors don't end", limit)
+			}
+			page, next, err := st.Page(ctx, limit, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) == 0 || len(page) > limit {
+				t.Errorf("limit %v: page %v has %v IDs", limit, pages, len(page))
+			}
+			listed = append(listed, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if fmt.Sprint(listed) != fmt.Sprint(ids) {
+			t.Errorf("limit %v: listed %v, want %v", limit, listed, ids)
+		}
+	}
+
+	all, next, err := st.Page(ctx, 0, "")
+	if err != nil || len(all) != len(ids) || next != "" {
+		t.Errorf("Page without limit = %v, %q, %v, want all IDs", all, next, err)
+	}
+	if _, _, err := st.Page(ctx, 2, "not a cursor!"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Page with an invalid cursor returned %v, want ErrInvalidCursor", err)
+	}
+	// a cursor past a deleted scan spec still continues after it:
+	_, cursor, err := st.Page(ctx, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Remove(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if page, _, err := st.Page(ctx, 2, cursor); err != nil || fmt.Sprint(page) != "[c d]" {
+		t.Errorf("Page after the removed scan spec = %v, %v, want [c d]", page, err)
+	}
+}
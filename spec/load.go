@@ -0,0 +1,90 @@
+package spec
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// DefaultConcurrency is the number of scan specs fetched in parallel
+// unless overridden by ECR_SCAN_SPEC_CONCURRENCY
+const DefaultConcurrency = 8
+
+// Result is the outcome of fetching a single scan spec
+type Result struct {
+	// ID is the ID of the scan spec that was fetched
+	ID string
+	// Spec is the scan spec, only valid if Err is nil
+	Spec ScanSpec
+	// Err is the error fetching the scan spec failed with, if any
+	Err error
+}
+
+// ConcurrencyFromEnv returns the number of parallel fetches configured in
+// the ECR_SCAN_SPEC_CONCURRENCY environment variable, or DefaultConcurrency
+func ConcurrencyFromEnv() int {
+	n, err := strconv.Atoi(os.Getenv("ECR_SCAN_SPEC_CONCURRENCY"))
+	if err != nil || n < 1 {
+		return DefaultConcurrency
+	}
+	return n
+}
+
+// LoadAll fetches the scan specs with the given IDs from the store, with
+// at most concurrency fetches in flight. The results are in the same order
+// as the IDs, and a failed fetch doesn't stop the others.
+func LoadAll(ctx context.Context, st SpecStore, ids []string, concurrency int) []Result {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(ids) {
+		concurrency = len(ids)
+	}
+	results := make([]Result, len(ids))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				ss, err := st.Fetch(ctx, ids[i])
+				results[i] = Result{ID: ids[i], Spec: ss, Err: err}
+			}
+		}()
+	}
+	for i := range ids {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// ListAll returns all stored scan specs, paging through the store
+func ListAll(ctx context.Context, st SpecStore) ([]Result, error) {
+	results := []Result{}
+	cursor := ""
+	for {
+		page, next, err := st.List(ctx, 0, cursor)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, page...)
+		if next == "" {
+			return results, nil
+		}
+		cursor = next
+	}
+}
+
+// loadPage lists a page of scan spec IDs and fetches the scan specs in
+// parallel, for stores that keep each scan spec separately
+func loadPage(ctx context.Context, st SpecStore, limit int, cursor string) ([]Result, string, error) {
+	ids, next, err := st.Page(ctx, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	return LoadAll(ctx, st, ids, ConcurrencyFromEnv()), next, nil
+}
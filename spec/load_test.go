@@ -0,0 +1,210 @@
+package spec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"ecr.amazon.com/internal/store"
+)
+
+// memStore is an in-memory SpecStore whose fetches take latency and fail
+// with the error set for their ID
+type memStore struct {
+	mu      sync.Mutex
+	specs   map[string]ScanSpec
+	errs    map[string]error
+	latency time.Duration
+}
+
+func newMemStore(n int, latency time.Duration) *memStore {
+	st := &memStore{specs: map[string]ScanSpec{}, errs: map[string]error{}, latency: latency}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("spec-%04d", i)
+		st.specs[id] = ScanSpec{ID: id, Repository: "repo-" + strconv.Itoa(i)}
+	}
+	return st
+}
+
+func (st *memStore) Store(ctx context.Context, scanspec ScanSpec) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.specs[scanspec.ID] = scanspec
+	return nil
+}
+
+func (st *memStore) StoreIf(ctx context.Context, scanspec ScanSpec, revision int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	current, ok := st.specs[scanspec.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if current.Revision != revision || current.LastRun != scanspec.LastRun {
+		return ErrConflict
+	}
+	st.specs[scanspec.ID] = scanspec
+	return nil
+}
+
+func (st *memStore) MarkRun(ctx context.Context, scanid string, lastRun string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	current, ok := st.specs[scanid]
+	if !ok {
+		return ErrNotFound
+	}
+	current.LastRun = lastRun
+	st.specs[scanid] = current
+	return nil
+}
+
+func (st *memStore) Fetch(ctx context.Context, scanid string) (ScanSpec, error) {
+	time.Sleep(st.latency)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.errs[scanid]; err != nil {
+		return ScanSpec{}, err
+	}
+	scanspec, ok := st.specs[scanid]
+	if !ok {
+		return ScanSpec{}, ErrNotFound
+	}
+	return scanspec, nil
+}
+
+func (st *memStore) Remove(ctx context.Context, scanid string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.specs, scanid)
+	return nil
+}
+
+func (st *memStore) RemoveIf(ctx context.Context, scanid string, revision int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	current, ok := st.specs[scanid]
+	if !ok {
+		return ErrNotFound
+	}
+	if current.Revision != revision {
+		return ErrConflict
+	}
+	delete(st.specs, scanid)
+	return nil
+}
+
+func (st *memStore) IDs(ctx context.Context) ([]string, error) {
+	return allIDs(ctx, st)
+}
+
+func (st *memStore) Page(ctx context.Context, limit int, cursor string) ([]string, string, error) {
+	st.mu.Lock()
+	ids := make([]string, 0, len(st.specs))
+	for id := range st.specs {
+		ids = append(ids, id)
+	}
+	st.mu.Unlock()
+	sort.Strings(ids)
+	start, err := store.DecodeCursor(cursor, ErrInvalidCursor)
+	if err != nil {
+		return nil, "", err
+	}
+	i := sort.SearchStrings(ids, start)
+	if limit < 1 || i+limit >= len(ids) {
+		return ids[i:], "", nil
+	}
+	return ids[i : i+limit], store.EncodeCursor(ids[i+limit]), nil
+}
+
+func (st *memStore) List(ctx context.Context, limit int, cursor string) ([]Result, string, error) {
+	return loadPage(ctx, st, limit, cursor)
+}
+
+func TestLoadAllOrder(t *testing.T) {
+	st := newMemStore(50, 0)
+	errBroken := errors.New("broken")
+	st.errs["spec-0007"] = errBroken
+	st.errs["spec-0031"] = errBroken
+	ids, err := st.IDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IDs that aren't stored come back as not found in their place:
+	ids = append([]string{"missing"}, ids...)
+	for _, concurrency := range []int{0, 1, 3, 8, 100} {
+		results := LoadAll(context.Background(), st, ids, concurrency)
+		if len(results) != len(ids) {
+			t.Fatalf("concurrency %v: got %v results for %v IDs", concurrency, len(results), len(ids))
+		}
+		for i, result := range results {
+			if result.ID != ids[i] {
+				t.Errorf("concurrency %v: result %v is for %v, want %v", concurrency, i, result.ID, ids[i])
+			}
+			var want error
+			switch ids[i] {
+			case "missing":
+				want = ErrNotFound
+			case "spec-0007", "spec-0031":
+				want = errBroken
+			}
+			if !errors.Is(result.Err, want) {
+				t.Errorf("concurrency %v: %v failed with %v, want %v", concurrency, ids[i], result.Err, want)
+			}
+			if want == nil && result.Spec.ID != ids[i] {
+				t.Errorf("concurrency %v: %v loaded scan spec %v", concurrency, ids[i], result.Spec.ID)
+			}
+		}
+	}
+}
+
+func TestListAll(t *testing.T) {
+	st := newMemStore(25, 0)
+	st.errs["spec-0012"] = errors.New("broken")
+	results := []Result{}
+	cursor := ""
+	for {
+		page, next, err := st.List(context.Background(), 10, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	all, err := ListAll(context.Background(), st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 25 || len(all) != 25 {
+		t.Fatalf("listed %v and %v scan specs, want 25", len(results), len(all))
+	}
+	for i := range all {
+		if results[i].ID != all[i].ID || (results[i].Err == nil) != (all[i].Err == nil) {
+			t.Errorf("result %v differs: paged %v (%v), all %v (%v)", i, results[i].ID, results[i].Err, all[i].ID, all[i].Err)
+		}
+	}
+}
+
+func BenchmarkLoadAll(b *testing.B) {
+	st := newMemStore(200, time.Millisecond)
+	st.errs["spec-0100"] = errors.New("broken")
+	ids, err := st.IDs(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, concurrency := range []int{1, 4, DefaultConcurrency, 32} {
+		b.Run(fmt.Sprintf("concurrency=%v", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				LoadAll(context.Background(), st, ids, concurrency)
+			}
+		})
+	}
+}
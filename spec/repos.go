@@ -0,0 +1,111 @@
+package spec
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// IsDiscovery reports whether the scan spec covers the repositories it
+// discovers in the registry rather than a single repository. That is the
+// case if its repository is empty, meaning every repository, a prefix
+// ending in /, or a glob.
+func (ss ScanSpec) IsDiscovery() bool {
+	return ss.Repository == "" || strings.HasSuffix(ss.Repository, "/") || strings.ContainsAny(ss.Repository, "*?[")
+}
+
+// ForRepository returns the scan spec narrowed down to one of the
+// repositories it discovered
+func (ss ScanSpec) ForRepository(repository string) ScanSpec {
+	narrowed := ss
+	narrowed.Repository = repository
+	narrowed.Discovered = true
+	return narrowed
+}
+
+// RepositorySelector decides which repositories of a registry a discovery
+// scan spec covers
+type RepositorySelector struct {
+	repository string
+	include    []tagMatcher
+	exclude    []tagMatcher
+}
+
+// NewRepositorySelector compiles the repository and the included and
+// excluded repositories of the scan spec into a RepositorySelector.
+// Included and excluded repositories are given as names or patterns, in
+// the same syntax as tag patterns.
+func NewRepositorySelector(scanspec ScanSpec) (*RepositorySelector, error) {
+	if err := ValidateRepositoryPattern(scanspec.Repository); err != nil {
+		return nil, err
+	}
+	rs := &RepositorySelector{repository: scanspec.Repository}
+	for _, pattern := range scanspec.IncludeRepositories {
+		m, err := compileTagPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rs.include = append(rs.include, m)
+	}
+	for _, pattern := range scanspec.ExcludeRepositories {
+		m, err := compileTagPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rs.exclude = append(rs.exclude, m)
+	}
+	return rs, nil
+}
+
+// ValidateRepositoryPattern returns an error if the repository of a
+// discovery scan spec is neither a prefix nor a valid glob
+func ValidateRepositoryPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// Matches reports whether the repository is selected: it has to match the
+// repository prefix or glob, any of the included repositories if given,
+// and none of the excluded ones
+func (rs *RepositorySelector) Matches(repository string) bool {
+	switch {
+	case rs.repository == "":
+	case strings.HasSuffix(rs.repository, "/"):
+		if !strings.HasPrefix(repository, rs.repository) {
+			return false
+		}
+	default:
+		if matched, _ := path.Match(rs.repository, repository); !matched {
+			return false
+		}
+	}
+	for _, m := range rs.exclude {
+		if m(repository) {
+			return false
+		}
+	}
+	if len(rs.include) == 0 {
+		return true
+	}
+	for _, m := range rs.include {
+		if m(repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesRepository reports whether the scan spec covers the repository,
+// either as its single repository or as one it discovers
+func (ss ScanSpec) MatchesRepository(repository string) (bool, error) {
+	if !ss.IsDiscovery() {
+		return ss.Repository == repository, nil
+	}
+	rs, err := NewRepositorySelector(ss)
+	if err != nil {
+		return false, err
+	}
+	return rs.Matches(repository), nil
+}
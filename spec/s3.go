@@ -0,0 +1,277 @@
+package spec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"ecr.amazon.com/internal/store"
+	"ecr.amazon.com/retry"
+)
+
+// S3Store keeps each scan spec as a JSON object named after its ID in a bucket
+type S3Store struct {
+	client *s3.Client
+	bucket string
+	policy retry.Policy
+}
+
+// NewS3Store returns a store for the scan specs in the given bucket
+func NewS3Store(ctx context.Context, bucket string) (*S3Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("no scan config bucket provided")
+	}
+	cfg, err := store.LoadConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{
+		client: s3.NewFromConfig(cfg),
+		bucket: bucket,
+		policy: retry.FromEnv(),
+	}, nil
+}
+
+func (st *S3Store) key(scanid string) string {
+	return scanid + ".json"
+}
+
+// Store uploads the scan spec to the bucket
+func (st *S3Store) Store(ctx context.Context, scanspec ScanSpec) error {
+	ssjson, err := json.Marshal(scanspec)
+	if err != nil {
+		return err
+	}
+	uploader := manager.NewUploader(st.client)
+	return st.policy.Do(ctx, func() error {
+		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(st.key(scanspec.ID)),
+			Body:   bytes.NewReader(ssjson),
+		})
+		return err
+	})
+}
+
+// StoreIf uploads the scan spec if the stored one has the given revision
+// and last run. The upload carries the ETag of the object checked in
+// If-Match, so S3 rejects it if the object changed in between.
+func (st *S3Store) StoreIf(ctx context.Context, scanspec ScanSpec, revision int) error {
+	current, etag, err := st.fetchTagged(ctx, scanspec.ID)
+	if errors.Is(err, ErrNotFound) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	if current.Revision != revision || current.LastRun != scanspec.LastRun {
+		return ErrConflict
+	}
+	return st.storeTagged(ctx, scanspec, etag)
+}
+
+// maxMarkAttempts is how often MarkRun tries to update a scan spec that
+// keeps changing under its feet
+const maxMarkAttempts = 3
+
+// MarkRun sets the last run of the scan spec, uploading it conditionally on
+// the ETag of the object it was downloaded as and trying again if the
+// object changed in between
+func (st *S3Store) MarkRun(ctx context.Context, scanid string, lastRun string) error {
+	for attempt := 0; attempt < maxMarkAttempts; attempt++ {
+		ss, etag, err := st.fetchTagged(ctx, scanid)
+		if err != nil {
+			return err
+		}
+		ss.LastRun = lastRun
+		err = st.storeTagged(ctx, ss, etag)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+// storeTagged uploads the scan spec if its object still has the given ETag
+func (st *S3Store) storeTagged(ctx context.Context, scanspec ScanSpec, etag string) error {
+	ssjson, err := json.Marshal(scanspec)
+	if err != nil {
+		return err
+	}
+	err = st.policy.Do(ctx, func() error {
+		_, err := st.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(st.key(scanspec.ID)),
+			Body:   bytes.NewReader(ssjson),
+		}, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-Match", etag)))
+		return err
+	})
+	return s3Conflict(err)
+}
+
+// Fetch downloads the scan spec with the given ID from the bucket
+func (st *S3Store) Fetch(ctx context.Context, scanid string) (ScanSpec, error) {
+	ss, _, err := st.fetchTagged(ctx, scanid)
+	return ss, err
+}
+
+// fetchTagged downloads the scan spec with the given ID along with the
+// ETag of its object
+func (st *S3Store) fetchTagged(ctx context.Context, scanid string) (ScanSpec, string, error) {
+	ss := ScanSpec{}
+	var ssjson []byte
+	etag := ""
+	err := st.policy.Do(ctx, func() error {
+		resp, err := st.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(st.key(scanid)),
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		etag = aws.ToString(resp.ETag)
+		ssjson, err = ioutil.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return ss, "", ErrNotFound
+		}
+		return ss, "", err
+	}
+	err = json.Unmarshal(ssjson, &ss)
+	if err != nil {
+		return ss, "", err
+	}
+	return ss, etag, nil
+}
+
+// checkRevision returns the ETag of the scan spec with the given ID if it
+// has the given revision, and ErrConflict otherwise
+func (st *S3Store) checkRevision(ctx context.Context, scanid string, revision int) (string, error) {
+	current, etag, err := st.fetchTagged(ctx, scanid)
+	if errors.Is(err, ErrNotFound) {
+		return "", ErrConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	if current.Revision != revision {
+		return "", ErrConflict
+	}
+	return etag, nil
+}
+
+// s3Conflict turns a failed If-Match condition into ErrConflict
+func s3Conflict(err error) error {
+	var re *smithyhttp.ResponseError
+	if errors.As(err, &re) && (re.HTTPStatusCode() == http.StatusPreconditionFailed || re.HTTPStatusCode() == http.StatusConflict) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Remove deletes the scan spec with the given ID from the bucket
+func (st *S3Store) Remove(ctx context.Context, scanid string) error {
+	return st.policy.Do(ctx, func() error {
+		_, err := st.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(st.key(scanid)),
+		})
+		return err
+	})
+}
+
+// RemoveIf deletes the scan spec with the given ID from the bucket if it has
+// the given revision. The delete carries the ETag of the object checked in
+// If-Match, which S3 only enforces in buckets supporting conditional
+// deletes; elsewhere an update landing between the check and the delete is
+// lost.
+func (st *S3Store) RemoveIf(ctx context.Context, scanid string, revision int) error {
+	etag, err := st.checkRevision(ctx, scanid, revision)
+	if err != nil {
+		return err
+	}
+	err = st.policy.Do(ctx, func() error {
+		_, err := st.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(st.bucket),
+			Key:    aws.String(st.key(scanid)),
+		}, s3.WithAPIOptions(smithyhttp.SetHeaderValue("If-Match", etag)))
+		return err
+	})
+	return s3Conflict(err)
+}
+
+// IDs lists all scan spec objects in the bucket
+func (st *S3Store) IDs(ctx context.Context) ([]string, error) {
+	return allIDs(ctx, st)
+}
+
+// List downloads up to limit scan specs from the bucket, in parallel
+func (st *S3Store) List(ctx context.Context, limit int, cursor string) ([]Result, string, error) {
+	return loadPage(ctx, st, limit, cursor)
+}
+
+// Page lists up to limit scan spec objects in the bucket, in key order.
+// Keys under a prefix, such as the run records under runs/, are rolled up
+// by the delimiter, but S3 still counts each prefix toward MaxKeys like a
+// key, so Page keeps listing until it has one ID more than limit, which
+// also tells whether there is another page. The cursor wraps the last ID
+// returned, which the next page starts after.
+func (st *S3Store) Page(ctx context.Context, limit int, cursor string) ([]string, string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(st.bucket),
+		Delimiter: aws.String("/"),
+	}
+	if limit > 0 {
+		input.MaxKeys = int32(limit + 1)
+	}
+	if cursor != "" {
+		lastID, err := store.DecodeCursor(cursor, ErrInvalidCursor)
+		if err != nil {
+			return nil, "", err
+		}
+		input.StartAfter = aws.String(st.key(lastID))
+	}
+	ids := []string{}
+	for limit <= 0 || len(ids) <= limit {
+		var resp *s3.ListObjectsV2Output
+		err := st.policy.Do(ctx, func() error {
+			var err error
+			resp, err = st.client.ListObjectsV2(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		for _, obj := range resp.Contents {
+			fn := aws.ToString(obj.Key)
+			if !strings.HasSuffix(fn, ".json") {
+				continue
+			}
+			ids = append(ids, strings.TrimSuffix(fn, ".json"))
+		}
+		if !resp.IsTruncated || resp.NextContinuationToken == nil {
+			break
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+	if limit <= 0 || len(ids) <= limit {
+		return ids, "", nil
+	}
+	ids = ids[:limit]
+	return ids, store.EncodeCursor(ids[limit-1]), nil
+}
@@ -0,0 +1,68 @@
+package spec
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"ecr.amazon.com/internal/s3test"
+	"ecr.amazon.com/retry"
+)
+
+// newStubS3Store returns an S3 store listing the keys from a stub
+func newStubS3Store(t *testing.T, keys []string) *S3Store {
+	client := s3test.NewListingClient(t, keys)
+	return &S3Store{client: client, bucket: "ecr-continuous-scan-config", policy: retry.Policy{MaxAttempts: 1}}
+}
+
+func TestS3PageSkipsRuns(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+	keys := []string{"README.md", "runs/x", "runs/y/a.json", "zz/config.json"}
+	for _, id := range ids {
+		keys = append(keys, id+".json")
+	}
+	st := newStubS3Store(t, keys)
+
+	ctx := context.Background()
+	for _, limit := range []int{1, 2, 3, 5, 10} {
+		listed := []string{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(ids) {
+				t.Fatalf("limit %v: cursors don't end", limit)
+			}
+			page, next, err := st.Page(ctx, limit, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := len(ids) - len(listed)
+			if want > limit {
+				want = limit
+			}
+			if len(page) != want {
+				t.Errorf("limit %v: page %v has %v scan specs %v, want %v", limit, pages, len(page), page, want)
+			}
+			listed = append(listed, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		if fmt.Sprint(listed) != fmt.Sprint(ids) {
+			t.Errorf("limit %v: listed %v, want %v", limit, listed, ids)
+		}
+	}
+
+	// the prefix of the runs after the last scan spec doesn't make for an
+	// empty last page:
+	st = newStubS3Store(t, []string{"a.json", "b.json", "runs/x"})
+	if page, next, err := st.Page(ctx, 2, ""); err != nil || fmt.Sprint(page) != "[a b]" || next != "" {
+		t.Errorf("Page = %v, %q, %v, want [a b] without cursor", page, next, err)
+	}
+	if all, next, err := st.Page(ctx, 0, ""); err != nil || len(all) != 2 || next != "" {
+		t.Errorf("Page without limit = %v, %q, %v, want all IDs", all, next, err)
+	}
+	if _, _, err := st.Page(ctx, 2, "not a cursor!"); err != ErrInvalidCursor {
+		t.Errorf("Page with an invalid cursor returned %v, want ErrInvalidCursor", err)
+	}
+}
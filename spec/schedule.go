@@ -0,0 +1,245 @@
+package spec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSchedule is the schedule of scan specs that don't set one
+const DefaultSchedule = "rate(24 hours)"
+
+// Schedule tells when a scan spec is due next. Schedules are given as
+// EventBridge schedule expressions, rate(value unit) or
+// cron(minutes hours day-of-month month day-of-week year), evaluated in UTC.
+type Schedule interface {
+	// Next returns the first time strictly after the given time at which
+	// the schedule fires, or the zero time if it never fires again
+	Next(after time.Time) time.Time
+}
+
+// ParseSchedule parses a rate or cron expression
+func ParseSchedule(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	switch {
+	case strings.HasPrefix(expr, "rate(") && strings.HasSuffix(expr, ")"):
+		return parseRate(strings.TrimSuffix(strings.TrimPrefix(expr, "rate("), ")"))
+	case strings.HasPrefix(expr, "cron(") && strings.HasSuffix(expr, ")"):
+		return parseCron(strings.TrimSuffix(strings.TrimPrefix(expr, "cron("), ")"))
+	default:
+		return nil, fmt.Errorf("%q is neither a rate(...) nor a cron(...) expression", expr)
+	}
+}
+
+// Due reports whether the scan spec is due at the given time, according to
+// its schedule or, if it has none, the given default schedule. A scan spec
+// that never ran is always due.
+// It also returns the slot the scan spec is due for, the latest time at or
+// before now its schedule fired, to be recorded as its last run. Counting
+// from the slot rather than from the time of dispatch keeps the delay of
+// the dispatcher from adding up over the runs of a rate schedule.
+func (ss ScanSpec) Due(now time.Time, defaultSchedule string) (time.Time, bool, error) {
+	expr := ss.Schedule
+	if expr == "" {
+		expr = defaultSchedule
+	}
+	sched, err := ParseSchedule(expr)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if ss.LastRun == "" {
+		return now, true, nil
+	}
+	lastrun, err := strconv.ParseInt(ss.LastRun, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid last run time %q: %w", ss.LastRun, err)
+	}
+	next := sched.Next(time.Unix(lastrun, 0))
+	if next.IsZero() || next.After(now) {
+		return time.Time{}, false, nil
+	}
+	return latestSlot(sched, next, now), true, nil
+}
+
+// latestSlot returns the last time at or before now the schedule fires,
+// given a time it fired at
+func latestSlot(sched Schedule, fired time.Time, now time.Time) time.Time {
+	if r, ok := sched.(rate); ok {
+		missed := now.Sub(fired) / time.Duration(r)
+		return fired.Add(missed * time.Duration(r))
+	}
+	for {
+		next := sched.Next(fired)
+		if next.IsZero() || next.After(now) {
+			return fired
+		}
+		fired = next
+	}
+}
+
+// rate fires in fixed intervals
+type rate time.Duration
+
+func parseRate(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("rate expression must be rate(value unit)")
+	}
+	value, err := strconv.Atoi(fields[0])
+	if err != nil || value < 1 {
+		return nil, fmt.Errorf("rate value %q must be a positive integer", fields[0])
+	}
+	var unit time.Duration
+	switch fields[1] {
+	case "minute", "minutes":
+		unit = time.Minute
+	case "hour", "hours":
+		unit = time.Hour
+	case "day", "days":
+		unit = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("rate unit %q must be minutes, hours or days", fields[1])
+	}
+	return rate(time.Duration(value) * unit), nil
+}
+
+func (r rate) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(r))
+}
+
+// cronField describes the values a field of a cron expression can take
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{name: "minutes", min: 0, max: 59},
+	{name: "hours", min: 0, max: 23},
+	{name: "day-of-month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{name: "day-of-week", min: 1, max: 7, names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+	{name: "year", min: 1970, max: 2199},
+}
+
+// cron fires at the minutes matching all of its fields. A nil set matches
+// any value, as * and ? do.
+type cron struct {
+	minutes, hours, days, months, weekdays, years map[int]bool
+}
+
+func parseCron(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression must have 6 fields: minutes hours day-of-month month day-of-week year")
+	}
+	sets := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	if (fields[2] == "?") == (fields[4] == "?") {
+		return nil, fmt.Errorf("exactly one of day-of-month and day-of-week must be ?")
+	}
+	return cron{
+		minutes:  sets[0],
+		hours:    sets[1],
+		days:     sets[2],
+		months:   sets[3],
+		weekdays: sets[4],
+		years:    sets[5],
+	}, nil
+}
+
+// parseCronField parses a comma separated list of *, values, ranges and
+// steps such as 5, MON-FRI, or */15
+func parseCronField(field string, def cronField) (map[int]bool, error) {
+	if field == "*" || field == "?" {
+		return nil, nil
+	}
+	set := map[int]bool{}
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %v field %q", def.name, field)
+			}
+			item = item[:i]
+		}
+		from, to := def.min, def.max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			from, err = cronValue(bounds[0], def)
+			if err != nil {
+				return nil, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = cronValue(bounds[1], def)
+				if err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				to = def.max
+			}
+			if from > to {
+				return nil, fmt.Errorf("invalid range in %v field %q", def.name, field)
+			}
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// cronValue parses a single number or name of a cron field
+func cronValue(s string, def cronField) (int, error) {
+	for i, name := range def.names {
+		if strings.EqualFold(s, name) {
+			return def.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q in %v field is not supported", s, def.name)
+	}
+	if v < def.min || v > def.max {
+		return 0, fmt.Errorf("%v in %v field must be between %v and %v", v, def.name, def.min, def.max)
+	}
+	return v, nil
+}
+
+func matches(set map[int]bool, v int) bool {
+	return set == nil || set[v]
+}
+
+func (c cron) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	end := time.Date(cronFields[5].max+1, 1, 1, 0, 0, 0, 0, time.UTC)
+	for t.Before(end) {
+		switch {
+		case !matches(c.years, t.Year()):
+			t = time.Date(t.Year()+1, 1, 1, 0, 0, 0, 0, time.UTC)
+		case !matches(c.months, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !matches(c.days, t.Day()) || !matches(c.weekdays, int(t.Weekday())+1):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !matches(c.hours, t.Hour()):
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !matches(c.minutes, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,205 @@
+package spec
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func utc(year int, month time.Month, day, hour, min, sec int) time.Time {
+	return time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"rate(1 minute)", true},
+		{"rate(5 minutes)", true},
+		{"rate(24 hours)", true},
+		{"rate(7 days)", true},
+		{"rate(0 hours)", false},
+		{"rate(1 fortnight)", false},
+		{"rate(hourly)", false},
+		{"cron(0 * * * ? *)", true},
+		{"cron(0/15 8-17 ? * MON-FRI *)", true},
+		{"cron(0 12 1,15 * ? 2026-2030)", true},
+		{"cron(0 12 ? JAN-MAR SUN *)", true},
+		// exactly one of day-of-month and day-of-week must be ?:
+		{"cron(0 12 * * * *)", false},
+		{"cron(0 12 ? * ? *)", false},
+		{"cron(0 12 1 * MON *)", false},
+		{"cron(0 12 L * ? *)", false},
+		{"cron(60 * * * ? *)", false},
+		{"cron(0 * * * ?)", false},
+		{"@hourly", false},
+	}
+	for _, test := range tests {
+		_, err := ParseSchedule(test.expr)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseSchedule(%q) returned error %v, want valid %v", test.expr, err, test.valid)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// 2026-10-14 is a Wednesday
+	wednesday := utc(2026, 10, 14, 10, 30, 7)
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"rate(1 hour)", wednesday, utc(2026, 10, 14, 11, 30, 7)},
+		{"rate(2 days)", wednesday, utc(2026, 10, 16, 10, 30, 7)},
+		{"cron(0 * * * ? *)", wednesday, utc(2026, 10, 14, 11, 0, 0)},
+		{"cron(0/15 * * * ? *)", wednesday, utc(2026, 10, 14, 10, 45, 0)},
+		{"cron(30 10 * * ? *)", utc(2026, 10, 14, 10, 30, 0), utc(2026, 10, 15, 10, 30, 0)},
+		// day-of-week counts from SUN=1, so 1 is Sunday and 2 Monday:
+		{"cron(0 12 ? * SUN *)", wednesday, utc(2026, 10, 18, 12, 0, 0)},
+		{"cron(0 12 ? * 1 *)", wednesday, utc(2026, 10, 18, 12, 0, 0)},
+		{"cron(0 12 ? * 2 *)", wednesday, utc(2026, 10, 19, 12, 0, 0)},
+		{"cron(0 12 ? * 7 *)", wednesday, utc(2026, 10, 17, 12, 0, 0)},
+		{"cron(0 8 ? * MON-FRI *)", utc(2026, 10, 16, 9, 0, 0), utc(2026, 10, 19, 8, 0, 0)},
+		{"cron(0 0 1 * ? *)", wednesday, utc(2026, 11, 1, 0, 0, 0)},
+		{"cron(0 0 31 * ? *)", utc(2026, 10, 31, 1, 0, 0), utc(2026, 12, 31, 0, 0, 0)},
+		{"cron(0 0 29 FEB ? *)", wednesday, utc(2028, 2, 29, 0, 0, 0)},
+		{"cron(0 0 1 JAN ? 2020)", wednesday, time.Time{}},
+	}
+	for _, test := range tests {
+		sched, err := ParseSchedule(test.expr)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %v", test.expr, err)
+		}
+		if got := sched.Next(test.after); !got.Equal(test.want) {
+			t.Errorf("%v: Next(%v) = %v, want %v", test.expr, test.after, got, test.want)
+		}
+	}
+}
+
+func TestDue(t *testing.T) {
+	lastRun := func(t time.Time) string { return fmt.Sprintf("%v", t.Unix()) }
+	tests := []struct {
+		name     string
+		scanspec ScanSpec
+		now      time.Time
+		due      bool
+		slot     time.Time
+	}{
+		{
+			name:     "never run",
+			scanspec: ScanSpec{Schedule: "rate(1 hour)"},
+			now:      utc(2026, 10, 14, 10, 0, 7),
+			due:      true,
+			slot:     utc(2026, 10, 14, 10, 0, 7),
+		},
+		{
+			name:     "rate not yet due",
+			scanspec: ScanSpec{Schedule: "rate(1 hour)", LastRun: lastRun(utc(2026, 10, 14, 10, 0, 7))},
+			now:      utc(2026, 10, 14, 11, 0, 5),
+			due:      false,
+		},
+		{
+			name:     "rate due late keeps the slot",
+			scanspec: ScanSpec{Schedule: "rate(1 hour)", LastRun: lastRun(utc(2026, 10, 14, 10, 0, 7))},
+			now:      utc(2026, 10, 14, 11, 4, 58),
+			due:      true,
+			slot:     utc(2026, 10, 14, 11, 0, 7),
+		},
+		{
+			name:     "rate due after missed slots",
+			scanspec: ScanSpec{Schedule: "rate(1 hour)", LastRun: lastRun(utc(2026, 10, 14, 10, 0, 7))},
+			now:      utc(2026, 10, 16, 9, 30, 0),
+			due:      true,
+			slot:     utc(2026, 10, 16, 9, 0, 7),
+		},
+		{
+			name:     "default schedule",
+			scanspec: ScanSpec{LastRun: lastRun(utc(2026, 10, 13, 10, 0, 0))},
+			now:      utc(2026, 10, 14, 10, 0, 0),
+			due:      true,
+			slot:     utc(2026, 10, 14, 10, 0, 0),
+		},
+		{
+			name:     "cron not yet due",
+			scanspec: ScanSpec{Schedule: "cron(0 * * * ? *)", LastRun: lastRun(utc(2026, 10, 14, 10, 0, 0))},
+			now:      utc(2026, 10, 14, 10, 59, 58),
+			due:      false,
+		},
+		{
+			name:     "cron due",
+			scanspec: ScanSpec{Schedule: "cron(0 * * * ? *)", LastRun: lastRun(utc(2026, 10, 14, 10, 0, 0))},
+			now:      utc(2026, 10, 14, 11, 4, 58),
+			due:      true,
+			slot:     utc(2026, 10, 14, 11, 0, 0),
+		},
+		{
+			name:     "cron on Sundays only",
+			scanspec: ScanSpec{Schedule: "cron(0 12 ? * SUN *)", LastRun: lastRun(utc(2026, 10, 11, 12, 0, 0))},
+			now:      utc(2026, 10, 17, 12, 30, 0),
+			due:      false,
+		},
+		{
+			name:     "cron due after missed slots",
+			scanspec: ScanSpec{Schedule: "cron(0 12 ? * SUN *)", LastRun: lastRun(utc(2026, 10, 4, 12, 0, 0))},
+			now:      utc(2026, 10, 18, 12, 3, 0),
+			due:      true,
+			slot:     utc(2026, 10, 18, 12, 0, 0),
+		},
+		{
+			name:     "cron never fires again",
+			scanspec: ScanSpec{Schedule: "cron(0 0 1 JAN ? 2020)", LastRun: lastRun(utc(2020, 1, 1, 0, 0, 0))},
+			now:      utc(2026, 10, 14, 10, 0, 0),
+			due:      false,
+		},
+	}
+	for _, test := range tests {
+		slot, due, err := test.scanspec.Due(test.now, DefaultSchedule)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if due != test.due || (due && !slot.Equal(test.slot)) {
+			t.Errorf("%v: Due(%v) = %v, %v, want %v, %v", test.name, test.now, slot, due, test.slot, test.due)
+		}
+	}
+}
+
+func TestDueInvalid(t *testing.T) {
+	now := utc(2026, 10, 14, 10, 0, 0)
+	if _, _, err := (ScanSpec{Schedule: "rate(soon)"}).Due(now, DefaultSchedule); err == nil {
+		t.Error("Due with an invalid schedule didn't fail")
+	}
+	if _, _, err := (ScanSpec{LastRun: "yesterday"}).Due(now, DefaultSchedule); err == nil {
+		t.Error("Due with an invalid last run didn't fail")
+	}
+}
+
+// TestDueDoesNotDrift dispatches on a 5 minute tick that fires a few seconds
+// early or late, and checks that a rate schedule keeps to its slots
+func TestDueDoesNotDrift(t *testing.T) {
+	start := utc(2026, 10, 14, 0, 0, 0)
+	scanspec := ScanSpec{Schedule: "rate(1 hour)", LastRun: fmt.Sprintf("%v", start.Unix())}
+	runs := 0
+	// one tick past the week, as the last one fires a second early:
+	for tick := 1; tick <= 12*24*7+1; tick++ {
+		jitter := time.Duration(tick%5-2) * time.Second
+		now := start.Add(time.Duration(tick)*5*time.Minute + jitter)
+		slot, due, err := scanspec.Due(now, DefaultSchedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !due {
+			continue
+		}
+		runs++
+		if slot.Sub(start)%time.Hour != 0 {
+			t.Fatalf("tick %v at %v dispatched for slot %v, off the hour", tick, now, slot)
+		}
+		scanspec.LastRun = fmt.Sprintf("%v", slot.Unix())
+	}
+	if runs != 24*7 {
+		t.Errorf("dispatched %v times in a week, want %v", runs, 24*7)
+	}
+}
@@ -0,0 +1,175 @@
+// Package spec holds the scan spec shared by the ECR continuous scan
+// functions, along with the stores the scan specs are kept in.
+package spec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ScanSpec represents configuration for the target repository
+type ScanSpec struct {
+	// ID is a unique identifier for the scan spec
+	ID string `json:"id"`
+	// CreationTime is the UTC timestamp of when the scan spec was created
+	CreationTime string `json:"created"`
+	// ModificationTime is the UTC timestamp of when the scan spec was last updated
+	ModificationTime string `json:"modified,omitempty"`
+	// Region specifies the region the repository is in
+	Region string `json:"region"`
+	// RegistryID specifies the registry ID
+	RegistryID string `json:"registry"`
+	// Repository specifies the repository name, or, to discover repositories
+	// in the registry, a prefix ending in / or a glob such as payments/*.
+	// Empty means every repository in the registry.
+	Repository string `json:"repository"`
+	// IncludeRepositories limits a discovery scan spec to the repositories
+	// matching any of the given names or patterns
+	IncludeRepositories []string `json:"includeRepositories,omitempty"`
+	// ExcludeRepositories lists repositories or repository patterns a
+	// discovery scan spec skips
+	ExcludeRepositories []string `json:"excludeRepositories,omitempty"`
+	// RoleARN is an IAM role to assume for accessing the registry, for
+	// registries in other accounts
+	RoleARN string `json:"roleArn,omitempty"`
+	// ExternalID is passed along when assuming RoleARN, if the role requires it
+	ExternalID string `json:"externalId,omitempty"`
+	// Tags to take into consideration, if empty and no tag patterns are
+	// given, all tags will be scanned
+	Tags []string `json:"tags"`
+	// TagPatterns selects tags by glob, or by RE2 regular expression if
+	// prefixed with "re:", in addition to Tags
+	TagPatterns []string `json:"tagPatterns,omitempty"`
+	// ExcludeTags lists tags or tag patterns to skip even if selected otherwise
+	ExcludeTags []string `json:"excludeTags,omitempty"`
+	// Digests pins images by digest, in addition to the images selected by tag
+	Digests []string `json:"digests,omitempty"`
+	// Latest limits the selected images to the given number of most recently
+	// pushed ones, 0 means no limit
+	Latest int `json:"latest,omitempty"`
+	// PushedWithinDays limits the selected images to those pushed within the
+	// given number of days, 0 means no limit
+	PushedWithinDays int `json:"pushedWithinDays,omitempty"`
+	// Schedule is a rate(...) or cron(...) expression telling when the scan
+	// spec is due, DefaultSchedule if empty
+	Schedule string `json:"schedule,omitempty"`
+	// Enabled turns scanning of the scan spec off if false, unset means enabled
+	Enabled *bool `json:"enabled,omitempty"`
+	// SnoozeUntil pauses scanning of the scan spec until the given RFC 3339 time
+	SnoozeUntil string `json:"snoozeUntil,omitempty"`
+	// LastRun is the UTC timestamp of the schedule slot the scan spec was
+	// last dispatched for, maintained by the scanner through MarkRun
+	LastRun string `json:"lastRun,omitempty"`
+	// Discovered marks a scan spec narrowed down to one of the repositories
+	// of a discovery scan spec, it's never stored
+	Discovered bool `json:"-"`
+	// Revision is incremented with every update and backs the ETag of the scan spec
+	Revision int `json:"revision"`
+}
+
+// IsEnabled reports whether scanning of the scan spec is enabled
+func (ss ScanSpec) IsEnabled() bool {
+	return ss.Enabled == nil || *ss.Enabled
+}
+
+// Snoozed reports whether scanning of the scan spec is paused at the given
+// time, returning the end of the snooze if so
+func (ss ScanSpec) Snoozed(now time.Time) (time.Time, bool) {
+	until, err := time.Parse(time.RFC3339, ss.SnoozeUntil)
+	if err != nil || !until.After(now) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Active reports whether the scan spec is to be scanned at the given time,
+// being enabled and not snoozed
+func (ss ScanSpec) Active(now time.Time) bool {
+	_, snoozed := ss.Snoozed(now)
+	return ss.IsEnabled() && !snoozed
+}
+
+// ErrNotFound is returned by a SpecStore if no scan spec with the
+// requested ID exists
+var ErrNotFound = errors.New("scan spec not found")
+
+// ErrConflict is returned by a SpecStore if a conditional write or delete
+// finds the scan spec changed since it was read
+var ErrConflict = errors.New("scan spec changed concurrently")
+
+// ErrInvalidCursor is returned by a SpecStore if the cursor passed to
+// Page wasn't issued by that store
+var ErrInvalidCursor = errors.New("invalid scan spec cursor")
+
+// SpecStore persists scan specs, keyed by their ID
+type SpecStore interface {
+	// Store creates or overwrites the scan spec
+	Store(ctx context.Context, scanspec ScanSpec) error
+	// StoreIf overwrites the scan spec only if the stored one has the given
+	// revision and the last run of scanspec, atomically, and returns
+	// ErrConflict otherwise
+	StoreIf(ctx context.Context, scanspec ScanSpec, revision int) error
+	// MarkRun sets the last run of the scan spec with the given ID, leaving
+	// the rest of the scan spec and its revision alone
+	MarkRun(ctx context.Context, scanid string, lastRun string) error
+	// Fetch returns the scan spec with the given ID or ErrNotFound
+	Fetch(ctx context.Context, scanid string) (ScanSpec, error)
+	// Remove deletes the scan spec with the given ID
+	Remove(ctx context.Context, scanid string) error
+	// RemoveIf deletes the scan spec with the given ID only if it has the
+	// given revision, and returns ErrConflict otherwise
+	RemoveIf(ctx context.Context, scanid string, revision int) error
+	// IDs returns the IDs of all stored scan specs
+	IDs(ctx context.Context) ([]string, error)
+	// Page returns up to limit scan spec IDs, starting at the given cursor.
+	// An empty cursor starts at the beginning and a limit of 0 leaves the
+	// page size to the store. The returned cursor is opaque to callers and
+	// empty once all IDs have been returned.
+	Page(ctx context.Context, limit int, cursor string) ([]string, string, error)
+	// List returns up to limit scan specs, starting at the given cursor, in
+	// the order and with the cursors of Page. A scan spec that can't be
+	// loaded is returned as a Result with Err set.
+	List(ctx context.Context, limit int, cursor string) ([]Result, string, error)
+}
+
+// allIDs collects the IDs of all scan specs by paging through the store
+func allIDs(ctx context.Context, st SpecStore) ([]string, error) {
+	ids := []string{}
+	cursor := ""
+	for {
+		page, next, err := st.Page(ctx, 0, cursor)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, page...)
+		if next == "" {
+			return ids, nil
+		}
+		cursor = next
+	}
+}
+
+// NewFromEnv returns the SpecStore selected by the ECR_SCAN_SPEC_STORE
+// environment variable, which is one of "s3" (the default), "dynamodb"
+// or "file". The S3 store uses the bucket in ECR_SCAN_CONFIG_BUCKET, the
+// DynamoDB store the table in ECR_SCAN_CONFIG_TABLE, and the file store
+// the directory in ECR_SCAN_CONFIG_DIR.
+//
+// The functions call it once per Lambda instance, in main, so that warm
+// invocations reuse the client of the store. They do the same with
+// history.NewFromEnv and queue.NewFromEnv.
+func NewFromEnv(ctx context.Context) (SpecStore, error) {
+	switch kind := os.Getenv("ECR_SCAN_SPEC_STORE"); kind {
+	case "", "s3":
+		return NewS3Store(ctx, os.Getenv("ECR_SCAN_CONFIG_BUCKET"))
+	case "dynamodb":
+		return NewDynamoDBStore(ctx, os.Getenv("ECR_SCAN_CONFIG_TABLE"))
+	case "file":
+		return NewFileStore(os.Getenv("ECR_SCAN_CONFIG_DIR"))
+	default:
+		return nil, fmt.Errorf("unknown scan spec store %q", kind)
+	}
+}
@@ -0,0 +1,110 @@
+package spec
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a tag pattern as RE2 regular expression, patterns
+// without it are globs
+const regexPrefix = "re:"
+
+// tagMatcher reports whether a tag matches a single tag pattern
+type tagMatcher func(tag string) bool
+
+// compileTagPattern turns a tag pattern into a matcher. Globs support
+// *, ? and character classes, regular expressions must match the whole tag.
+func compileTagPattern(pattern string) (tagMatcher, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		expr := strings.TrimPrefix(pattern, regexPrefix)
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", expr, err)
+		}
+		re := regexp.MustCompile("^(?:" + expr + ")$")
+		return re.MatchString, nil
+	}
+	// check the glob syntax once up front, so matching can't fail later on:
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return func(tag string) bool {
+		matched, _ := path.Match(pattern, tag)
+		return matched
+	}, nil
+}
+
+// ValidateTagPattern returns an error if the tag pattern doesn't compile
+func ValidateTagPattern(pattern string) error {
+	_, err := compileTagPattern(pattern)
+	return err
+}
+
+// TagSelector decides which image tags of a repository a scan spec covers
+type TagSelector struct {
+	all     bool
+	exact   map[string]bool
+	include []tagMatcher
+	exclude []tagMatcher
+}
+
+// NewTagSelector compiles the tags, tag patterns and excluded tags of the
+// scan spec into a TagSelector. Without tags, tag patterns or digests,
+// the scan spec selects all tags.
+func NewTagSelector(scanspec ScanSpec) (*TagSelector, error) {
+	ts := &TagSelector{
+		all:   len(scanspec.Tags) == 0 && len(scanspec.TagPatterns) == 0 && len(scanspec.Digests) == 0,
+		exact: map[string]bool{},
+	}
+	for _, tag := range scanspec.Tags {
+		ts.exact[tag] = true
+	}
+	for _, pattern := range scanspec.TagPatterns {
+		m, err := compileTagPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		ts.include = append(ts.include, m)
+	}
+	for _, pattern := range scanspec.ExcludeTags {
+		m, err := compileTagPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		ts.exclude = append(ts.exclude, m)
+	}
+	return ts, nil
+}
+
+// Matches reports whether the tag is selected
+func (ts *TagSelector) Matches(tag string) bool {
+	for _, m := range ts.exclude {
+		if m(tag) {
+			return false
+		}
+	}
+	if ts.all {
+		return true
+	}
+	if ts.exact[tag] {
+		return true
+	}
+	for _, m := range ts.include {
+		if m(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns the selected tags among the given ones, in their order
+func (ts *TagSelector) Select(tags []string) []string {
+	selected := []string{}
+	for _, tag := range tags {
+		if ts.Matches(tag) {
+			selected = append(selected, tag)
+		}
+	}
+	return selected
+}
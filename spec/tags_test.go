@@ -0,0 +1,140 @@
+package spec
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testTags = []string{
+	"latest",
+	"v1.2",
+	"v1.2-slim",
+	"v1.10-slim",
+	"v2.0-slim",
+	"release-2026.01",
+	"release-2026.10",
+	"release-2025.12",
+	"release-2026.10-rc1",
+	"nightly-20261014",
+}
+
+func TestTagSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		scanspec ScanSpec
+		all      bool
+		want     []string
+	}{
+		{
+			name:     "all when nothing is set",
+			scanspec: ScanSpec{},
+			all:      true,
+			want:     testTags,
+		},
+		{
+			name:     "exact tags",
+			scanspec: ScanSpec{Tags: []string{"latest", "v1.2", "unknown"}},
+			want:     []string{"latest", "v1.2"},
+		},
+		{
+			name:     "glob with a dot",
+			scanspec: ScanSpec{TagPatterns: []string{"release-2026.*"}},
+			want:     []string{"release-2026.01", "release-2026.10", "release-2026.10-rc1"},
+		},
+		{
+			name:     "glob in the middle",
+			scanspec: ScanSpec{TagPatterns: []string{"v1.*-slim"}},
+			want:     []string{"v1.2-slim", "v1.10-slim"},
+		},
+		{
+			name:     "glob with a character class",
+			scanspec: ScanSpec{TagPatterns: []string{"v[12].?-slim"}},
+			want:     []string{"v1.2-slim", "v2.0-slim"},
+		},
+		{
+			name:     "regular expression is anchored",
+			scanspec: ScanSpec{TagPatterns: []string{`re:release-\d{4}\.\d{2}`}},
+			want:     []string{"release-2026.01", "release-2026.10", "release-2025.12"},
+		},
+		{
+			name:     "regular expression alternatives are anchored",
+			scanspec: ScanSpec{TagPatterns: []string{"re:latest|v1"}},
+			want:     []string{"latest"},
+		},
+		{
+			name:     "regular expression needs a wildcard for a prefix",
+			scanspec: ScanSpec{TagPatterns: []string{"re:nightly-.*"}},
+			want:     []string{"nightly-20261014"},
+		},
+		{
+			name:     "tags and patterns combine",
+			scanspec: ScanSpec{Tags: []string{"latest"}, TagPatterns: []string{"v2.*"}},
+			want:     []string{"latest", "v2.0-slim"},
+		},
+		{
+			name:     "excludes override tags",
+			scanspec: ScanSpec{Tags: []string{"latest", "v1.2"}, ExcludeTags: []string{"latest"}},
+			want:     []string{"v1.2"},
+		},
+		{
+			name:     "excludes override tag patterns",
+			scanspec: ScanSpec{TagPatterns: []string{"release-2026.*"}, ExcludeTags: []string{"*-rc*"}},
+			want:     []string{"release-2026.01", "release-2026.10"},
+		},
+		{
+			name:     "excludes with regular expressions",
+			scanspec: ScanSpec{TagPatterns: []string{"v*"}, ExcludeTags: []string{`re:v1\..*`}},
+			want:     []string{"v2.0-slim"},
+		},
+		{
+			name:     "excludes alone narrow all tags",
+			scanspec: ScanSpec{ExcludeTags: []string{"release-*", "nightly-*"}},
+			all:      true,
+			want:     []string{"latest", "v1.2", "v1.2-slim", "v1.10-slim", "v2.0-slim"},
+		},
+		{
+			name:     "digests only select no tags",
+			scanspec: ScanSpec{Digests: []string{"sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}},
+			all:      false,
+			want:     []string{},
+		},
+	}
+	for _, test := range tests {
+		ts, err := NewTagSelector(test.scanspec)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if ts.all != test.all {
+			t.Errorf("%v: all is %v, want %v", test.name, ts.all, test.all)
+		}
+		if got := ts.Select(testTags); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: selected %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidateTagPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"release-*", true},
+		{"v1.?", true},
+		{"[a-z]*", true},
+		{"[a-", false},
+		{`re:^v\d+$`, true},
+		{"re:v(1", false},
+		{`re:\p{Bogus}`, false},
+	}
+	for _, test := range tests {
+		err := ValidateTagPattern(test.pattern)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateTagPattern(%q) returned error %v, want valid %v", test.pattern, err, test.valid)
+		}
+	}
+	_, err := NewTagSelector(ScanSpec{ExcludeTags: []string{"re:(("}})
+	if err == nil {
+		t.Error("NewTagSelector with an invalid exclude didn't fail")
+	}
+}
@@ -2,38 +2,51 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	_ "image/jpeg"
 	_ "image/png"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
+
+	"ecr.amazon.com/ratelimit"
+	"ecr.amazon.com/spec"
+	"ecr.amazon.com/target"
+)
+
+const (
+	// defaultDeadlineMargin is the time that has to be left before the
+	// deadline of the invocation to start describing another scan spec,
+	// unless overridden by ECR_SCAN_SUMMARY_DEADLINE_MARGIN
+	defaultDeadlineMargin = 3 * time.Second
+	// responseMargin is the time kept free before the deadline to return
+	// the response, cutting short the scan spec being described
+	responseMargin = time.Second
+	// partialHeader is "true" if the summary leaves out scan specs
+	partialHeader = "X-Scan-Summary-Partial"
+	// skippedHeader lists the IDs of the scan specs left out for lack of
+	// time, comma separated
+	skippedHeader = "X-Scan-Summary-Skipped"
+	// errorsHeader lists the IDs of the scan specs left out as they can't be
+	// loaded or described, comma separated
+	errorsHeader = "X-Scan-Summary-Errors"
 )
 
-// ScanSpec represents configuration for the target repository
-type ScanSpec struct {
-	// ID is a unique identifier for the scan spec
-	ID string `json:"id"`
-	// CreationTime is the UTC timestamp of when the scan spec was created
-	CreationTime string `json:"created"`
-	// Region specifies the region the repository is in
-	Region string `json:"region"`
-	// RegistryID specifies the registry ID
-	RegistryID string `json:"registry"`
-	// Repository specifies the repository name
-	Repository string `json:"repository"`
-	// Tags to take into consideration, if empty, all tags will be scanned
-	Tags []string `json:"tags"`
+// deadlineMarginFromEnv returns the margin set in
+// ECR_SCAN_SUMMARY_DEADLINE_MARGIN, which is never less than responseMargin
+func deadlineMarginFromEnv() time.Duration {
+	margin, err := time.ParseDuration(os.Getenv("ECR_SCAN_SUMMARY_DEADLINE_MARGIN"))
+	if err != nil {
+		return defaultDeadlineMargin
+	}
+	if margin < responseMargin {
+		return responseMargin
+	}
+	return margin
 }
 
 func serverError(err error) (events.APIGatewayProxyResponse, error) {
@@ -47,140 +60,121 @@ func serverError(err error) (events.APIGatewayProxyResponse, error) {
 	}, nil
 }
 
-// fetchScanSpec returns the scan spec
-// in a given bucket, with a given scan ID
-func fetchScanSpec(configbucket, scanid string) (ScanSpec, error) {
-	ss := ScanSpec{}
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return ss, err
-	}
-
-	// Create an S3 Client with the config
-	client := s3.NewFromConfig(cfg)
-
-	// Create an uploader passing it the client
-	downloader := manager.NewDownloader(client)
-
-	buf := aws.NewWriteAtBuffer([]byte{})
-	_, err = downloader.Download(context.TODO(), buf, &s3.GetObjectInput{
-		Bucket: aws.String(configbucket),
-		Key:    aws.String(scanid + ".json"),
-	})
-	if err != nil {
-		return ss, err
+// scanStatus returns a note for scan specs that aren't scanned at the
+// moment, so that their findings aren't mistaken for current ones
+func scanStatus(scanspec spec.ScanSpec, now time.Time) string {
+	if !scanspec.IsEnabled() {
+		return " (scanning disabled)"
 	}
-	err = json.Unmarshal(buf.Bytes(), &ss)
-	if err != nil {
-		return ss, err
+	if until, ok := scanspec.Snoozed(now); ok {
+		return fmt.Sprintf(" (scanning snoozed until %v)", until.Format(time.RFC3339))
 	}
-	return ss, nil
+	return ""
 }
 
-func describeScan(scanspec ScanSpec) (map[string]ecr.ImageScanFindings, error) {
-	s := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(scanspec.Region),
-	}))
-	svc := ecr.New(s)
-	descinput := &ecr.DescribeImageScanFindingsInput{
-		RepositoryName: &scanspec.Repository,
-		RegistryId:     &scanspec.RegistryID,
-	}
-	results := map[string]ecr.ImageScanFindings{}
-	switch len(scanspec.Tags) {
-	case 0: // empty list of tags, describe all tags:
-		fmt.Printf("DEBUG:: scanning all tags for repo %v\n", scanspec.Repository)
-		lio, err := svc.ListImages(&ecr.ListImagesInput{
-			RepositoryName: &scanspec.Repository,
-			RegistryId:     &scanspec.RegistryID,
-			Filter: &ecr.ListImagesFilter{
-				TagStatus: aws.String("TAGGED"),
-			},
-		})
-		if err != nil {
-			fmt.Println(err)
-			return results, err
-		}
-		for _, iid := range lio.ImageIds {
-			descinput.ImageId = iid
-			result, err := svc.DescribeImageScanFindings(descinput)
-			if err != nil {
-				return results, err
-			}
-			results[*iid.ImageTag] = *result.ImageScanFindings
-			// fmt.Printf("DEBUG:: result for tag %v: %v\n", *iid.ImageTag, result)
-		}
-	default: // iterate over the tags specified in the config:
-		fmt.Printf("DEBUG:: scanning tags %v for repo %v\n", scanspec.Tags, scanspec.Repository)
-		for _, tag := range scanspec.Tags {
-			descinput.ImageId = &ecr.ImageIdentifier{
-				ImageTag: aws.String(tag),
-			}
-			result, err := svc.DescribeImageScanFindings(descinput)
-			if err != nil {
-				fmt.Println(err)
-				return results, err
-			}
-			results[tag] = *result.ImageScanFindings
-			// fmt.Printf("DEBUG:: result for tag %v: %v\n", tag, result)
-		}
-	}
-	return results, nil
-}
+var store spec.SpecStore
 
-func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	configbucket := os.Getenv("ECR_SCAN_CONFIG_BUCKET")
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	fmt.Printf("DEBUG:: summary start\n")
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	loadedSpecs, err := spec.ListAll(ctx, store)
 	if err != nil {
 		fmt.Println(err)
 		return serverError(err)
 	}
-	svc := s3.NewFromConfig(cfg)
-	fmt.Printf("Scanning bucket %v for scan specs\n", configbucket)
-	resp, err := svc.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: &configbucket,
-	},
-	)
-	// resp, err := req.Send(context.TODO())
+	limiter, err := ratelimit.ReadFromEnv()
 	if err != nil {
 		fmt.Println(err)
 		return serverError(err)
 	}
+	// describe scan specs only while there's time left to respond, leaving
+	// out the remaining ones rather than being killed at the timeout:
+	deadline, hasDeadline := ctx.Deadline()
+	margin := deadlineMarginFromEnv()
+	descctx := ctx
+	if hasDeadline {
+		var cancel context.CancelFunc
+		descctx, cancel = context.WithDeadline(ctx, deadline.Add(-responseMargin))
+		defer cancel()
+	}
+	skipped := []string{}
+	failed := []string{}
 	ssresult := ""
-	for _, obj := range resp.Contents {
-		fn := *obj.Key
-		scanID := strings.TrimSuffix(fn, ".json")
-		scanspec, err := fetchScanSpec(configbucket, scanID)
-		if err != nil {
-			fmt.Println(err)
-			return serverError(err)
+	for _, loaded := range loadedSpecs {
+		if loaded.Err != nil {
+			fmt.Printf("Can't load scan spec %v: %v\n", loaded.ID, loaded.Err)
+			ssresult += fmt.Sprintf("Results for scan spec %v:\n error: %v\n\n", loaded.ID, loaded.Err)
+			failed = append(failed, loaded.ID)
+			continue
 		}
-		results, err := describeScan(scanspec)
+		if hasDeadline && time.Until(deadline) < margin {
+			skipped = append(skipped, loaded.ID)
+			continue
+		}
+		scanspec := loaded.Spec
+		results, err := target.Describe(descctx, scanspec, limiter)
+		if err != nil && descctx.Err() != nil {
+			fmt.Printf("DEBUG:: ran out of time describing scan spec %v: %v\n", loaded.ID, err)
+			skipped = append(skipped, loaded.ID)
+			continue
+		}
+		status := scanStatus(scanspec, time.Now())
 		if err != nil {
-			fmt.Println(err)
-			return serverError(err)
+			// a single scan spec that can't be described doesn't take down
+			// the summary of the others:
+			fmt.Printf("Can't describe scan spec %v: %v\n", loaded.ID, err)
+			ssresult += fmt.Sprintf("Results for scan spec %v in %v%v:\n error: %v\n\n", loaded.ID, scanspec.Region, status, err)
+			failed = append(failed, loaded.ID)
+			continue
 		}
-		for tag, result := range results {
+		for _, result := range results {
+			if result.NotFound {
+				ssresult += fmt.Sprintf("Results for %v in %v%v:\n not found\n\n", result.Image.Reference(result.Repository), scanspec.Region, status)
+				continue
+			}
+			if !result.Scanned() {
+				ssresult += fmt.Sprintf("Results for %v in %v%v:\n scan %v: %v\n\n", result.Image.Reference(result.Repository), scanspec.Region, status, result.ScanStatus, result.ScanStatusDescription)
+				continue
+			}
 			sevcount := ""
-			for sev, count := range result.FindingSeverityCounts {
-				sevcount += fmt.Sprintf(" %v: %v\n", sev, *count)
+			for sev, count := range result.Findings.FindingSeverityCounts {
+				sevcount += fmt.Sprintf(" %v: %v\n", sev, count)
 			}
-			ssresult += fmt.Sprintf("Results for %v:%v in %v:\n%v\n\n", scanspec.Repository, tag, scanspec.Region, sevcount)
+			ssresult += fmt.Sprintf("Results for %v in %v%v:\n%v\n\n", result.Image.Reference(result.Repository), scanspec.Region, status, sevcount)
 		}
 	}
-
+	headers := map[string]string{
+		"Content-Type":                  "application/json",
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Expose-Headers": partialHeader + ", " + skippedHeader + ", " + errorsHeader,
+		partialHeader:                   "false",
+	}
+	if len(skipped) > 0 || len(failed) > 0 {
+		fmt.Printf("DEBUG:: summary partial, skipped %v scan specs, %v failed\n", len(skipped), len(failed))
+		ssresult += "partial: true\n"
+		headers[partialHeader] = "true"
+	}
+	if len(skipped) > 0 {
+		ssresult += fmt.Sprintf("skipped: %v\n", strings.Join(skipped, ", "))
+		headers[skippedHeader] = strings.Join(skipped, ",")
+	}
+	if len(failed) > 0 {
+		ssresult += fmt.Sprintf("errors: %v\n", strings.Join(failed, ", "))
+		headers[errorsHeader] = strings.Join(failed, ",")
+	}
 	fmt.Printf("DEBUG:: summary done\n")
 	return events.APIGatewayProxyResponse{
 		StatusCode: http.StatusOK,
-		Headers: map[string]string{
-			"Content-Type":                "application/json",
-			"Access-Control-Allow-Origin": "*",
-		},
-		Body: ssresult,
+		Headers:    headers,
+		Body:       ssresult,
 	}, nil
 }
 
 func main() {
+	var err error
+	store, err = spec.NewFromEnv(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	lambda.Start(handler)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"ecr.amazon.com/spec"
+)
+
+func TestHandlerReportsUnloadableSpecs(t *testing.T) {
+	dir := t.TempDir()
+	st, err := spec.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"corrupt-a", "corrupt-b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, id+".json"), []byte(`{"id": "`+id+`",`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = st
+	defer func() { store = nil }()
+	resp, err := handler(context.Background(), events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %v, want %v: %v", resp.StatusCode, http.StatusOK, resp.Body)
+	}
+	if resp.Headers[partialHeader] != "true" || resp.Headers[errorsHeader] != "corrupt-a,corrupt-b" {
+		t.Errorf("headers %v, want partial with errors for both scan specs", resp.Headers)
+	}
+	if _, ok := resp.Headers[skippedHeader]; ok {
+		t.Errorf("headers %v skip scan specs that failed to load", resp.Headers)
+	}
+	for _, header := range []string{skippedHeader, errorsHeader} {
+		if !strings.Contains(resp.Headers["Access-Control-Expose-Headers"], header) {
+			t.Errorf("headers %v don't expose %v", resp.Headers, header)
+		}
+	}
+	if !strings.Contains(resp.Body, "Results for scan spec corrupt-a:\n error: ") {
+		t.Errorf("body %q lacks the error of the corrupt scan spec", resp.Body)
+	}
+	if !strings.HasSuffix(resp.Body, "partial: true\nerrors: corrupt-a, corrupt-b\n") {
+		t.Errorf("body %q lacks the partial trailer", resp.Body)
+	}
+}
+
+func TestHandlerComplete(t *testing.T) {
+	st, err := spec.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = st
+	defer func() { store = nil }()
+	resp, err := handler(context.Background(), events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Headers[partialHeader] != "false" {
+		t.Errorf("status %v and headers %v, want a complete summary", resp.StatusCode, resp.Headers)
+	}
+	for _, header := range []string{skippedHeader, errorsHeader} {
+		if _, ok := resp.Headers[header]; ok {
+			t.Errorf("complete summary has %v header", header)
+		}
+	}
+}
+
+func TestHandlerReportsSpecsFailingToDescribe(t *testing.T) {
+	st, err := spec.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tag pattern fails to compile before ECR is called:
+	err = st.Store(context.Background(), spec.ScanSpec{
+		ID:          "broken",
+		Region:      "us-west-2",
+		RegistryID:  "123456789012",
+		Repository:  "app",
+		TagPatterns: []string{"re:(("},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = st
+	defer func() { store = nil }()
+	resp, err := handler(context.Background(), events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %v, want %v: %v", resp.StatusCode, http.StatusOK, resp.Body)
+	}
+	if resp.Headers[partialHeader] != "true" || resp.Headers[errorsHeader] != "broken" || resp.Headers[skippedHeader] != "" {
+		t.Errorf("headers %v, want partial with an error for the broken scan spec", resp.Headers)
+	}
+	if !strings.Contains(resp.Body, "Results for scan spec broken in us-west-2:\n error: ") {
+		t.Errorf("body %q lacks the error of the broken scan spec", resp.Body)
+	}
+}
+
+func TestHandlerStopsAtDeadlineMargin(t *testing.T) {
+	st, err := spec.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		err := st.Store(context.Background(), spec.ScanSpec{ID: id, Region: "us-west-2", RegistryID: "123456789012", Repository: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store = st
+	defer func() { store = nil }()
+	// less time left than the margin, so that no scan spec is described:
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDeadlineMargin/2)
+	defer cancel()
+	resp, err := handler(ctx, events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %v, want %v: %v", resp.StatusCode, http.StatusOK, resp.Body)
+	}
+	if resp.Headers[partialHeader] != "true" || resp.Headers[skippedHeader] != "a,b" {
+		t.Errorf("headers %v, want partial with both scan specs skipped", resp.Headers)
+	}
+	if resp.Body != "partial: true\nskipped: a, b\n" {
+		t.Errorf("body %q, want only the partial trailer", resp.Body)
+	}
+}
+
+func TestHandlerSeparatesErrorsFromSkipped(t *testing.T) {
+	dir := t.TempDir()
+	st, err := spec.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		err := st.Store(context.Background(), spec.ScanSpec{ID: id, Region: "us-west-2", RegistryID: "123456789012", Repository: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "corrupt.json"), []byte(`{"id": "corrupt",`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store = st
+	defer func() { store = nil }()
+	// the valid scan specs run out of time, the corrupt one is broken:
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDeadlineMargin/2)
+	defer cancel()
+	resp, err := handler(ctx, events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Headers[partialHeader] != "true" || resp.Headers[skippedHeader] != "a,b" || resp.Headers[errorsHeader] != "corrupt" {
+		t.Errorf("headers %v, want a and b skipped and an error for corrupt", resp.Headers)
+	}
+	if !strings.HasSuffix(resp.Body, "partial: true\nskipped: a, b\nerrors: corrupt\n") {
+		t.Errorf("body %q lacks the partial trailer", resp.Body)
+	}
+}
@@ -0,0 +1,122 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/ratelimit"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+// Findings holds the scan findings of a single image
+type Findings struct {
+	// Repository is the repository the image is in
+	Repository string
+	// Image is the image the findings are for
+	Image Image
+	// Findings are the findings of the last scan of the image, empty while
+	// the scan is in progress or if it failed
+	Findings types.ImageScanFindings
+	// ScanStatus is the status ECR reported for the last scan of the image
+	ScanStatus types.ScanStatus
+	// ScanStatusDescription is the description ECR gave for the scan status
+	ScanStatusDescription string
+	// NotFound marks a tag or digest the scan spec lists that doesn't exist
+	// in the repository, which has no findings
+	NotFound bool
+}
+
+// Describe returns the scan findings of every image the scan spec selects,
+// in every repository it covers, each DescribeImageScanFindings call
+// waiting for the limiter. Images that don't exist are returned as NotFound
+// rather than failing the whole description.
+func Describe(ctx context.Context, scanspec spec.ScanSpec, limiter *ratelimit.Limiter) ([]Findings, error) {
+	results := []Findings{}
+	svc, err := ecrclient.ForSpec(ctx, scanspec)
+	if err != nil {
+		fmt.Println(err)
+		return results, err
+	}
+	policy := retry.FromEnv()
+	repospecs, err := Expand(ctx, svc, policy, scanspec)
+	if err != nil {
+		fmt.Println(err)
+		return results, err
+	}
+	for _, repospec := range repospecs {
+		repofindings, err := describeRepository(ctx, svc, policy, limiter, repospec)
+		results = append(results, repofindings...)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// describeRepository returns the scan findings of the images the scan spec
+// selects in its repository
+func describeRepository(ctx context.Context, svc ecrclient.API, policy retry.Policy, limiter *ratelimit.Limiter, scanspec spec.ScanSpec) ([]Findings, error) {
+	descinput := &ecr.DescribeImageScanFindingsInput{
+		RepositoryName: &scanspec.Repository,
+		RegistryId:     &scanspec.RegistryID,
+	}
+	results := []Findings{}
+	images, err := Resolve(ctx, svc, policy, scanspec)
+	if err != nil {
+		fmt.Println(err)
+		return results, err
+	}
+	fmt.Printf("DEBUG:: describing %v images for repo %v\n", len(images), scanspec.Repository)
+	for _, img := range images {
+		// a tag that didn't resolve to a digest doesn't exist in the repository:
+		if img.Digest == "" {
+			results = append(results, Findings{Repository: scanspec.Repository, Image: img, NotFound: true})
+			continue
+		}
+		descinput.ImageId = img.ImageID()
+		var result *ecr.DescribeImageScanFindingsOutput
+		err := policy.Do(ctx, func() error {
+			if err := limiter.Wait(ctx, scanspec.Region); err != nil {
+				return err
+			}
+			var err error
+			result, err = svc.DescribeImageScanFindings(ctx, descinput)
+			return err
+		})
+		var imageNotFound *types.ImageNotFoundException
+		if errors.As(err, &imageNotFound) {
+			fmt.Printf("DEBUG:: image %v not found in repo %v\n", img.Name(), scanspec.Repository)
+			results = append(results, Findings{Repository: scanspec.Repository, Image: img, NotFound: true})
+			continue
+		}
+		if err != nil {
+			fmt.Println(err)
+			return results, err
+		}
+		imgfindings := Findings{Repository: scanspec.Repository, Image: img}
+		// a scan in progress or failed has a status, but no findings:
+		if result.ImageScanStatus != nil {
+			imgfindings.ScanStatus = result.ImageScanStatus.Status
+			imgfindings.ScanStatusDescription = aws.ToString(result.ImageScanStatus.Description)
+		}
+		if result.ImageScanFindings != nil {
+			imgfindings.Findings = *result.ImageScanFindings
+		}
+		results = append(results, imgfindings)
+	}
+	return results, nil
+}
+
+// Scanned reports whether the last scan of the image completed, so that its
+// findings are current. Findings without a scan status are taken as
+// complete.
+func (f Findings) Scanned() bool {
+	return f.ScanStatus == "" || f.ScanStatus == types.ScanStatusComplete
+}
@@ -0,0 +1,121 @@
+package target
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/ratelimit"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+const existingDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+// fakeECR holds a single image tagged v1, scanned with one critical finding,
+// and reports the scans of other digests with the given statuses
+type fakeECR struct {
+	ecrclient.API
+	described []string
+	scans     map[string]types.ImageScanStatus
+}
+
+func (f *fakeECR) DescribeImages(ctx context.Context, params *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	return &ecr.DescribeImagesOutput{ImageDetails: []types.ImageDetail{{
+		ImageDigest:   aws.String(existingDigest),
+		ImageTags:     []string{"v1"},
+		ImagePushedAt: aws.Time(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)),
+	}}}, nil
+}
+
+func (f *fakeECR) DescribeImageScanFindings(ctx context.Context, params *ecr.DescribeImageScanFindingsInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error) {
+	digest := aws.ToString(params.ImageId.ImageDigest)
+	f.described = append(f.described, digest)
+	if status, ok := f.scans[digest]; ok {
+		return &ecr.DescribeImageScanFindingsOutput{ImageScanStatus: &status}, nil
+	}
+	if digest != existingDigest {
+		return nil, &types.ImageNotFoundException{Message: aws.String("The image with imageId " + digest + " does not exist")}
+	}
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageScanStatus: &types.ImageScanStatus{Status: types.ScanStatusComplete},
+		ImageScanFindings: &types.ImageScanFindings{
+			FindingSeverityCounts: map[string]int32{"CRITICAL": 1},
+		},
+	}, nil
+}
+
+func TestDescribeRepositoryNotFound(t *testing.T) {
+	svc := &fakeECR{}
+	scanspec := spec.ScanSpec{
+		Region:     "us-west-2",
+		RegistryID: "123456789012",
+		Repository: "app",
+		Tags:       []string{"v1", "missing"},
+		Digests:    []string{"sha256:2222222222222222222222222222222222222222222222222222222222222222"},
+	}
+	policy := retry.Policy{MaxAttempts: 1}
+	findings, err := describeRepository(context.Background(), svc, policy, ratelimit.New(1000, 1000, nil), scanspec)
+	if err != nil {
+		t.Fatalf("describing failed: %v", err)
+	}
+	if len(findings) != 3 {
+		t.Fatalf("got findings for %v images, want 3", len(findings))
+	}
+	if findings[0].NotFound || findings[0].Findings.FindingSeverityCounts["CRITICAL"] != 1 {
+		t.Errorf("existing image has findings %+v", findings[0])
+	}
+	if !findings[1].NotFound || findings[1].Image.Name() != "missing" {
+		t.Errorf("missing tag has findings %+v, want it not found", findings[1])
+	}
+	if !findings[2].NotFound || findings[2].Image.Digest != scanspec.Digests[0] {
+		t.Errorf("missing digest has findings %+v, want it not found", findings[2])
+	}
+	// the missing tag has no digest to ask ECR about:
+	if len(svc.described) != 2 {
+		t.Errorf("described %v, want the existing and the missing digest", svc.described)
+	}
+}
+
+func TestDescribeRepositoryWithoutFindings(t *testing.T) {
+	inProgress := "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	failed := "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+	svc := &fakeECR{scans: map[string]types.ImageScanStatus{
+		inProgress: {Status: types.ScanStatusInProgress},
+		failed:     {Status: types.ScanStatusFailed, Description: aws.String("UnsupportedImageError: The operating system and/or package manager are not supported.")},
+	}}
+	scanspec := spec.ScanSpec{
+		Region:     "us-west-2",
+		RegistryID: "123456789012",
+		Repository: "app",
+		Tags:       []string{"v1"},
+		Digests:    []string{inProgress, failed},
+	}
+	policy := retry.Policy{MaxAttempts: 1}
+	findings, err := describeRepository(context.Background(), svc, policy, ratelimit.New(1000, 1000, nil), scanspec)
+	if err != nil {
+		t.Fatalf("describing failed: %v", err)
+	}
+	if len(findings) != 3 {
+		t.Fatalf("got findings for %v images, want 3", len(findings))
+	}
+	statuses := map[string]Findings{}
+	for _, f := range findings {
+		statuses[f.Image.Digest] = f
+	}
+	if f := statuses[existingDigest]; !f.Scanned() || f.Findings.FindingSeverityCounts["CRITICAL"] != 1 {
+		t.Errorf("scanned image has findings %+v", f)
+	}
+	if f := statuses[inProgress]; f.Scanned() || f.ScanStatus != types.ScanStatusInProgress || f.NotFound {
+		t.Errorf("image with a scan in progress has findings %+v", f)
+	}
+	if f := statuses[failed]; f.Scanned() || f.ScanStatus != types.ScanStatusFailed || !strings.HasPrefix(f.ScanStatusDescription, "UnsupportedImageError") {
+		t.Errorf("image with a failed scan has findings %+v", f)
+	}
+}
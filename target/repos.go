@@ -0,0 +1,59 @@
+package target
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+// Expand returns the scan spec narrowed down to each repository it covers,
+// in the order of their names. A scan spec for a single repository is
+// returned as is, a discovery scan spec is matched against the repositories
+// of its registry, each page of which is retried on its own according to
+// the policy.
+func Expand(ctx context.Context, svc ecrclient.API, policy retry.Policy, scanspec spec.ScanSpec) ([]spec.ScanSpec, error) {
+	if !scanspec.IsDiscovery() {
+		return []spec.ScanSpec{scanspec}, nil
+	}
+	sel, err := spec.NewRepositorySelector(scanspec)
+	if err != nil {
+		return nil, err
+	}
+	repositories := []string{}
+	input := &ecr.DescribeRepositoriesInput{
+		RegistryId: aws.String(scanspec.RegistryID),
+	}
+	for {
+		var page *ecr.DescribeRepositoriesOutput
+		err = policy.Do(ctx, func() error {
+			var err error
+			page, err = svc.DescribeRepositories(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range page.Repositories {
+			name := aws.ToString(repo.RepositoryName)
+			if sel.Matches(name) {
+				repositories = append(repositories, name)
+			}
+		}
+		if page.NextToken == nil {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	sort.Strings(repositories)
+	specs := []spec.ScanSpec{}
+	for _, repository := range repositories {
+		specs = append(specs, scanspec.ForRepository(repository))
+	}
+	return specs, nil
+}
@@ -0,0 +1,107 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+// registryECR returns its repositories a page per DescribeRepositories call
+type registryECR struct {
+	ecrclient.API
+	pages [][]string
+	calls int
+}
+
+func (f *registryECR) DescribeRepositories(ctx context.Context, params *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	f.calls++
+	page := 0
+	if params.NextToken != nil {
+		fmt.Sscan(*params.NextToken, &page)
+	}
+	out := &ecr.DescribeRepositoriesOutput{}
+	for _, name := range f.pages[page] {
+		out.Repositories = append(out.Repositories, types.Repository{RepositoryName: aws.String(name), RegistryId: params.RegistryId})
+	}
+	if page+1 < len(f.pages) {
+		out.NextToken = aws.String(fmt.Sprint(page + 1))
+	}
+	return out, nil
+}
+
+func TestExpand(t *testing.T) {
+	pages := [][]string{
+		{"team/api", "ubuntu", "team/web"},
+		{"amazonlinux", "team/api-legacy", "teams/other"},
+		{"team/sub/worker"},
+	}
+	tests := []struct {
+		name         string
+		edit         func(ss *spec.ScanSpec)
+		repositories []string
+	}{
+		{"whole registry", func(ss *spec.ScanSpec) {},
+			[]string{"amazonlinux", "team/api", "team/api-legacy", "team/sub/worker", "team/web", "teams/other", "ubuntu"}},
+		{"prefix", func(ss *spec.ScanSpec) { ss.Repository = "team/" },
+			[]string{"team/api", "team/api-legacy", "team/sub/worker", "team/web"}},
+		{"glob", func(ss *spec.ScanSpec) { ss.Repository = "team/*" },
+			[]string{"team/api", "team/api-legacy", "team/web"}},
+		{"glob with character class", func(ss *spec.ScanSpec) { ss.Repository = "[au]*" },
+			[]string{"amazonlinux", "ubuntu"}},
+		{"included repositories", func(ss *spec.ScanSpec) { ss.IncludeRepositories = []string{"ubuntu", "team/api*"} },
+			[]string{"team/api", "team/api-legacy", "ubuntu"}},
+		{"excluded repositories", func(ss *spec.ScanSpec) {
+			ss.Repository = "team/"
+			ss.ExcludeRepositories = []string{"team/*-legacy", "re:team/sub/.*"}
+		},
+			[]string{"team/api", "team/web"}},
+		{"excluded wins over included", func(ss *spec.ScanSpec) {
+			ss.IncludeRepositories = []string{"team/api*"}
+			ss.ExcludeRepositories = []string{"team/api-legacy"}
+		}, []string{"team/api"}},
+		{"nothing matches", func(ss *spec.ScanSpec) { ss.Repository = "missing/" }, []string{}},
+	}
+	for _, test := range tests {
+		scanspec := spec.ScanSpec{ID: "discovery", Region: "us-west-2", RegistryID: "123456789012"}
+		test.edit(&scanspec)
+		svc := &registryECR{pages: pages}
+		specs, err := Expand(context.Background(), svc, retry.Policy{MaxAttempts: 1}, scanspec)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		repositories := []string{}
+		for _, repospec := range specs {
+			repositories = append(repositories, repospec.Repository)
+			if !repospec.Discovered || repospec.ID != scanspec.ID || repospec.RegistryID != scanspec.RegistryID {
+				t.Errorf("%v: expanded to %+v, want a discovered scan spec of the same ID and registry", test.name, repospec)
+			}
+		}
+		if fmt.Sprint(repositories) != fmt.Sprint(test.repositories) {
+			t.Errorf("%v: expanded to %v, want %v", test.name, repositories, test.repositories)
+		}
+		if svc.calls != len(pages) {
+			t.Errorf("%v: described %v pages, want %v", test.name, svc.calls, len(pages))
+		}
+	}
+
+	single := spec.ScanSpec{ID: "single", Region: "us-west-2", RegistryID: "123456789012", Repository: "ubuntu"}
+	svc := &registryECR{pages: pages}
+	specs, err := Expand(context.Background(), svc, retry.Policy{MaxAttempts: 1}, single)
+	if err != nil || len(specs) != 1 || specs[0].Repository != "ubuntu" || specs[0].Discovered || svc.calls != 0 {
+		t.Errorf("Expand of a single repository = %+v, %v after %v calls, want it as is", specs, err, svc.calls)
+	}
+
+	invalid := spec.ScanSpec{Repository: "team/*", ExcludeRepositories: []string{"re:(("}}
+	if _, err := Expand(context.Background(), &registryECR{pages: pages}, retry.Policy{MaxAttempts: 1}, invalid); err == nil {
+		t.Error("Expand with an invalid excluded repository didn't fail")
+	}
+}
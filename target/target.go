@@ -0,0 +1,156 @@
+// Package target resolves the images in ECR that a scan spec selects for
+// scanning, shared by the scanner and the findings and summary views.
+package target
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+// now returns the current time, replaceable for deterministic runs
+var now = time.Now
+
+// Image is an image selected for scanning, identified by its digest.
+// Multiple tags pointing at the same image yield a single Image.
+type Image struct {
+	// Tags are the selected tags pointing at the image, empty if it was
+	// selected by digest only
+	Tags []string
+	// Digest is the image digest, empty if the image wasn't found in ECR
+	Digest string
+	// PushedAt is when the image was pushed, zero if the image wasn't found in ECR
+	PushedAt time.Time
+}
+
+// ImageID returns the identifier to pass to ECR for the image, which is
+// the digest if known so the scan applies to exactly the resolved image
+func (img Image) ImageID() *types.ImageIdentifier {
+	if img.Digest != "" {
+		return &types.ImageIdentifier{
+			ImageDigest: aws.String(img.Digest),
+		}
+	}
+	return &types.ImageIdentifier{
+		ImageTag: aws.String(img.Tags[0]),
+	}
+}
+
+// Name returns tags and digest of the image, as far as known, in the form
+// tag1,tag2@digest
+func (img Image) Name() string {
+	tags := strings.Join(img.Tags, ",")
+	switch {
+	case tags == "":
+		return img.Digest
+	case img.Digest == "":
+		return tags
+	default:
+		return tags + "@" + img.Digest
+	}
+}
+
+// Reference returns the image reference in the given repository, naming
+// all tags and the digest where known
+func (img Image) Reference(repository string) string {
+	if len(img.Tags) == 0 {
+		return repository + "@" + img.Digest
+	}
+	return repository + ":" + img.Name()
+}
+
+// Resolve returns the images in the repository of the scan spec that it
+// selects, most recently pushed first, with the selected tags grouped by
+// the digest they resolve to.
+// Images pinned by digest are always selected, the latest and
+// pushedWithinDays limits only apply to images selected by tag. Tags and
+// digests listed in the scan spec but missing from the repository are
+// returned last, unresolved, unless the repository was discovered, as the
+// tags and digests of a discovery scan spec don't have to exist in each of
+// its repositories.
+// Each page of images is retried on its own according to the policy.
+func Resolve(ctx context.Context, svc ecrclient.API, policy retry.Policy, scanspec spec.ScanSpec) ([]Image, error) {
+	sel, err := spec.NewTagSelector(scanspec)
+	if err != nil {
+		return nil, err
+	}
+	details := []types.ImageDetail{}
+	input := &ecr.DescribeImagesInput{
+		RepositoryName: aws.String(scanspec.Repository),
+		RegistryId:     aws.String(scanspec.RegistryID),
+	}
+	for {
+		var page *ecr.DescribeImagesOutput
+		err = policy.Do(ctx, func() error {
+			var err error
+			page, err = svc.DescribeImages(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		details = append(details, page.ImageDetails...)
+		if page.NextToken == nil {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	sort.SliceStable(details, func(i, j int) bool {
+		return aws.ToTime(details[i].ImagePushedAt).After(aws.ToTime(details[j].ImagePushedAt))
+	})
+	pinned := map[string]bool{}
+	for _, digest := range scanspec.Digests {
+		pinned[digest] = true
+	}
+	cutoff := time.Time{}
+	if scanspec.PushedWithinDays > 0 {
+		cutoff = now().AddDate(0, 0, -scanspec.PushedWithinDays)
+	}
+	images := []Image{}
+	seenTags := map[string]bool{}
+	seenDigests := map[string]bool{}
+	selectedImages := 0
+	for _, detail := range details {
+		digest := aws.ToString(detail.ImageDigest)
+		pushedAt := aws.ToTime(detail.ImagePushedAt)
+		repotags := detail.ImageTags
+		for _, tag := range repotags {
+			seenTags[tag] = true
+		}
+		seenDigests[digest] = true
+		tags := sel.Select(repotags)
+		if !pinned[digest] {
+			if len(tags) == 0 || pushedAt.Before(cutoff) {
+				continue
+			}
+			if scanspec.Latest > 0 && selectedImages == scanspec.Latest {
+				continue
+			}
+			selectedImages++
+		}
+		images = append(images, Image{Tags: tags, Digest: digest, PushedAt: pushedAt})
+	}
+	if scanspec.Discovered {
+		return images, nil
+	}
+	for _, tag := range sel.Select(scanspec.Tags) {
+		if !seenTags[tag] {
+			images = append(images, Image{Tags: []string{tag}})
+		}
+	}
+	for _, digest := range scanspec.Digests {
+		if !seenDigests[digest] {
+			images = append(images, Image{Digest: digest})
+		}
+	}
+	return images, nil
+}
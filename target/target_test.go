@@ -0,0 +1,150 @@
+package target
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/smithy-go"
+
+	"ecr.amazon.com/ecrclient"
+	"ecr.amazon.com/retry"
+	"ecr.amazon.com/spec"
+)
+
+// pagedECR returns its image details a page per DescribeImages call,
+// throttling the first throttles calls for each page
+type pagedECR struct {
+	ecrclient.API
+	pages     [][]types.ImageDetail
+	throttles int
+	calls     int
+	throttled map[string]int
+}
+
+func (f *pagedECR) DescribeImages(ctx context.Context, params *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	f.calls++
+	if f.throttled == nil {
+		f.throttled = map[string]int{}
+	}
+	if token := aws.ToString(params.NextToken); f.throttled[token] < f.throttles {
+		f.throttled[token]++
+		return nil, &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	}
+	page := 0
+	if params.NextToken != nil {
+		fmt.Sscan(*params.NextToken, &page)
+	}
+	out := &ecr.DescribeImagesOutput{ImageDetails: f.pages[page]}
+	if page+1 < len(f.pages) {
+		out.NextToken = aws.String(fmt.Sprint(page + 1))
+	}
+	return out, nil
+}
+
+// pushed returns the details of an image pushed the given days before 2026-10-15
+func pushed(digest string, daysAgo int, tags ...string) types.ImageDetail {
+	return types.ImageDetail{
+		ImageDigest:   aws.String(digest),
+		ImageTags:     tags,
+		ImagePushedAt: aws.Time(time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -daysAgo)),
+	}
+}
+
+func TestResolve(t *testing.T) {
+	defer func(saved func() time.Time) { now = saved }(now)
+	now = func() time.Time { return time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC) }
+	// the pages aren't in push order, Resolve sorts across them:
+	pages := [][]types.ImageDetail{
+		{pushed("sha256:d3", 44, "v1", "v1.0"), pushed("sha256:d1", 1, "latest", "v3"), pushed("sha256:d4", 3)},
+		{pushed("sha256:d5", 2, "dev-1"), pushed("sha256:d2", 5, "v2")},
+	}
+	tests := []struct {
+		name   string
+		edit   func(ss *spec.ScanSpec)
+		images []string
+	}{
+		{"all tags", func(ss *spec.ScanSpec) {},
+			[]string{"latest,v3@sha256:d1", "dev-1@sha256:d5", "v2@sha256:d2", "v1,v1.0@sha256:d3"}},
+		{"latest", func(ss *spec.ScanSpec) { ss.Latest = 2 },
+			[]string{"latest,v3@sha256:d1", "dev-1@sha256:d5"}},
+		{"pushed within days", func(ss *spec.ScanSpec) { ss.PushedWithinDays = 7 },
+			[]string{"latest,v3@sha256:d1", "dev-1@sha256:d5", "v2@sha256:d2"}},
+		{"latest of the pushed within days", func(ss *spec.ScanSpec) { ss.PushedWithinDays = 3; ss.Latest = 5 },
+			[]string{"latest,v3@sha256:d1", "dev-1@sha256:d5"}},
+		{"only selected tags of an image", func(ss *spec.ScanSpec) { ss.Tags = []string{"v1", "v3"} },
+			[]string{"v3@sha256:d1", "v1@sha256:d3"}},
+		{"missing tag", func(ss *spec.ScanSpec) { ss.Tags = []string{"v2", "missing"} },
+			[]string{"v2@sha256:d2", "missing"}},
+		{"excluded tags", func(ss *spec.ScanSpec) { ss.TagPatterns = []string{"v*"}; ss.ExcludeTags = []string{"v1*"} },
+			[]string{"v3@sha256:d1", "v2@sha256:d2"}},
+		{"latest after exclusion", func(ss *spec.ScanSpec) { ss.ExcludeTags = []string{"latest", "v3"}; ss.Latest = 1 },
+			[]string{"dev-1@sha256:d5"}},
+		{"pinned digests", func(ss *spec.ScanSpec) { ss.Digests = []string{"sha256:d3", "sha256:d4"} },
+			[]string{"sha256:d4", "sha256:d3"}},
+		{"pinned digests regardless of limits", func(ss *spec.ScanSpec) {
+			ss.Digests = []string{"sha256:d3"}
+			ss.Tags = []string{"v2", "dev-1"}
+			ss.Latest = 1
+			ss.PushedWithinDays = 7
+		}, []string{"dev-1@sha256:d5", "sha256:d3"}},
+		{"pinned digest with selected tag", func(ss *spec.ScanSpec) { ss.Digests = []string{"sha256:d1"}; ss.Tags = []string{"latest"} },
+			[]string{"latest@sha256:d1"}},
+		{"excluded tag of a pinned digest", func(ss *spec.ScanSpec) { ss.Digests = []string{"sha256:d1"}; ss.ExcludeTags = []string{"latest"} },
+			[]string{"sha256:d1"}},
+		{"missing digest", func(ss *spec.ScanSpec) { ss.Digests = []string{"sha256:d2", "sha256:missing"} },
+			[]string{"sha256:d2", "sha256:missing"}},
+		{"discovered repository", func(ss *spec.ScanSpec) {
+			ss.Tags = []string{"v2", "missing"}
+			ss.Digests = []string{"sha256:missing"}
+			ss.Discovered = true
+		}, []string{"v2@sha256:d2"}},
+	}
+	for _, test := range tests {
+		scanspec := spec.ScanSpec{Region: "us-west-2", RegistryID: "123456789012", Repository: "app"}
+		test.edit(&scanspec)
+		svc := &pagedECR{pages: pages}
+		images, err := Resolve(context.Background(), svc, retry.Policy{MaxAttempts: 1}, scanspec)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		names := []string{}
+		for _, img := range images {
+			names = append(names, img.Name())
+		}
+		if fmt.Sprint(names) != fmt.Sprint(test.images) {
+			t.Errorf("%v: resolved %v, want %v", test.name, names, test.images)
+		}
+		if svc.calls != len(pages) {
+			t.Errorf("%v: described %v pages, want %v", test.name, svc.calls, len(pages))
+		}
+	}
+
+	invalid := spec.ScanSpec{Repository: "app", TagPatterns: []string{"re:(("}}
+	if _, err := Resolve(context.Background(), &pagedECR{pages: pages}, retry.Policy{MaxAttempts: 1}, invalid); err == nil {
+		t.Error("Resolve with an invalid tag pattern didn't fail")
+	}
+}
+
+func TestResolveRetriesThrottledPages(t *testing.T) {
+	pages := [][]types.ImageDetail{{pushed("sha256:d1", 1, "v1")}, {pushed("sha256:d2", 2, "v2")}}
+	policy := retry.Policy{MaxAttempts: 3, Sleep: func(ctx context.Context, delay time.Duration) error { return nil }}
+	scanspec := spec.ScanSpec{Region: "us-west-2", RegistryID: "123456789012", Repository: "app"}
+
+	// each page is retried on its own, so the first page isn't described again:
+	svc := &pagedECR{pages: pages, throttles: 2}
+	images, err := Resolve(context.Background(), svc, policy, scanspec)
+	if err != nil || len(images) != 2 || svc.calls != 6 {
+		t.Errorf("Resolve = %v, %v after %v calls, want both images after 6 calls", images, err, svc.calls)
+	}
+
+	svc = &pagedECR{pages: pages, throttles: 3}
+	if _, err := Resolve(context.Background(), svc, policy, scanspec); !retry.IsThrottle(err) || svc.calls != 3 {
+		t.Errorf("Resolve returned %v after %v calls, want throttling after 3 calls", err, svc.calls)
+	}
+}